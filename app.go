@@ -8,12 +8,14 @@ package zerodt
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"runtime"
 	"sync"
 	"syscall"
 	"time"
@@ -23,6 +25,8 @@ var (
 	// Get original working directory just on start to reduce
 	// possibility of calling `os.Chdir` by somebody.
 	originalWD, _ = os.Getwd()
+
+	errAppNotServing = errors.New("app is not serving")
 )
 
 // App specifies functions to control passed HTTP servers.
@@ -49,12 +53,126 @@ type App struct {
 	// as a systemd's service.
 	PreParentExitFn func()
 
-	served                    sync.WaitGroup
-	servers                   []*http.Server
+	// WorkerCrashFn is a supervisor's hook that is called when a
+	// worker exits unexpectedly. The pid is 0 if a worker failed to
+	// start.
+	WorkerCrashFn func(pid int, err error)
+
+	// DrainReportFn is called with periodic drain reports of the app
+	// while it is shutting down and with reports of a parent received
+	// by a child (see SetDrainReportInterval).
+	DrainReportFn func(r DrainReport)
+
+	// ReopenLogsFn is called by "reopen-logs" control command. Useful
+	// for reopening log files after they were rotated.
+	ReopenLogsFn func() error
+
+	servers                   []*appServer
 	waitParentShutdownTimeout time.Duration
+	heartbeatInterval         time.Duration
+	drainReportInterval       time.Duration
 	waitChildTimeout          time.Duration
 	shutdownSync              sync.Mutex
 	wasShutdown               bool
+	drainStart                time.Time
+	done                      chan struct{}
+
+	// Runtime state guarded by mutex.
+	mutex    sync.Mutex
+	registry *Registry
+	started  bool
+	running  bool
+	serving  sync.WaitGroup
+	failFn   func(error)
+
+	// Restart state guarded by mutex.
+	state              State
+	restartPolicy      RestartPolicy
+	minRestartInterval time.Duration
+	lastRestart        time.Time
+	restartOp          *restartOp
+
+	// Previous generations guarded by mutex.
+	draining         []drainingProcess
+	maxDraining      int
+	escalationPolicy EscalationPolicy
+
+	// Status guarded by mutex. Only an owner writes files that describe
+	// the running generation.
+	statusFile        string
+	pidFile           string
+	pidLock           *os.File
+	owner             bool
+	generation        int
+	generationInfo    GenerationInfo
+	startTime         time.Time
+	lastRestartResult *RestartResult
+	// The status file is written in background. statusDone is closed
+	// when there is nothing to write.
+	statusPending bool
+	statusDone    chan struct{}
+
+	// Handshakes are aborted as soon as the App starts to shutdown. The
+	// wait group tracks handshakes that continue during the shutdown.
+	handshakeCtx     context.Context
+	cancelHandshakes context.CancelFunc
+	handshakeWG      sync.WaitGroup
+
+	// Control and rendezvous sockets guarded by mutex. Only an owner
+	// listens on them. The wait group tracks their connections.
+	controlPath        string
+	controlListener    *net.UnixListener
+	rendezvousPath     string
+	rendezvousListener *net.UnixListener
+	controlWG          sync.WaitGroup
+
+	// systemd's file descriptor store guarded by mutex.
+	fdStore bool
+
+	// LISTEN_PID handling guarded by mutex.
+	execHelper      bool
+	strictListenPID bool
+
+	// Supervisor mode guarded by mutex. A worker knows a pid of its
+	// supervisor, a supervisor knows the current worker.
+	supervisor     bool
+	masterPID      int
+	supervisorConn *RPCConn
+	workersCount   int
+	slots          []*workerSlot
+	workerExits    chan *workerProcess
+	// Closed when the supervisor stops receiving from workerExits.
+	workerExitsDone chan struct{}
+	crashPolicy     CrashRestartPolicy
+	crashes         []time.Time
+	crashCount      int
+}
+
+// appServer keeps a server with its runtime state.
+type appServer struct {
+	s *http.Server
+	l *net.TCPListener
+	// A key identifies server's listener across restarts.
+	key string
+	// Done after the first Accept call or in case a server failed
+	// to start serving.
+	served sync.WaitGroup
+	// servedOnce makes it safe to mark a server as served more than once.
+	servedOnce *doneOnce
+	// conns tracks server's connections.
+	conns connTracker
+	// stopped is closed when a serving server has finished serving.
+	stopped chan struct{}
+	// closed is set when the listener is closed before shutdown.
+	closed bool
+}
+
+func newAppServer(s *http.Server) *appServer {
+	as := &appServer{s: s}
+	// Need to be sure a server is serving before calling shutdown.
+	as.served.Add(1)
+	as.servedOnce = &doneOnce{wg: &as.served}
+	return as
 }
 
 // NewApp returns a new App instance.
@@ -64,15 +182,88 @@ func NewApp(servers ...*http.Server) *App {
 		PreShutdownFn:             func() {},
 		CompleteShutdownFn:        func() {},
 		PreParentExitFn:           func() {},
-		servers:                   servers,
+		ReopenLogsFn:              func() error { return nil },
+		WorkerCrashFn:             func(pid int, err error) {},
+		DrainReportFn:             func(r DrainReport) {},
 		waitChildTimeout:          time.Second * 60,
 		waitParentShutdownTimeout: 0,
+		heartbeatInterval:         time.Second * 5,
+		drainReportInterval:       time.Second * 5,
+		done:                      make(chan struct{}),
+		workersCount:              1,
+		crashPolicy: CrashRestartPolicy{
+			InitialBackoff: time.Millisecond * 100,
+			MaxBackoff:     time.Second * 30,
+			MaxCrashes:     5,
+			CrashWindow:    time.Minute,
+		},
+	}
+	a.handshakeCtx, a.cancelHandshakes = context.WithCancel(context.Background())
+	for _, s := range servers {
+		as := newAppServer(s)
+		as.key = a.defaultListenerKey(s.Addr)
+		a.servers = append(a.servers, as)
 	}
-	// Need to be sure all servers are serving before calling shutdown.
-	a.served.Add(len(a.servers))
 	return a
 }
 
+// defaultListenerKey makes a key for a listener of a new server. A key
+// is the address of a server with an ordinal if there are several
+// servers with the same address, e.g. for ephemeral ports. It must be
+// called with mutex held.
+func (a *App) defaultListenerKey(addr string) string {
+	key := addr
+	for i := 1; a.findServerByKey(key) != nil; i++ {
+		key = fmt.Sprintf("%s#%d", addr, i)
+	}
+	return key
+}
+
+// findServerByKey returns a server with the given listener key or nil.
+// It must be called with mutex held.
+func (a *App) findServerByKey(key string) *appServer {
+	for _, as := range a.servers {
+		if as.key == key {
+			return as
+		}
+	}
+	return nil
+}
+
+// SetListenerKey sets a key that identifies server's listener across
+// restarts. A child acquires an inherited listener with the same key
+// first and compares addresses only if there is no such key.
+//
+// A key must be unique and must be set before the server starts
+// listening. By default a key is the server's address.
+//
+// Keys are passed in LISTEN_FDNAMES with '%' and ':' percent-encoded,
+// e.g. ":8080" is passed as "%3A8080". A name set by systemd is
+// decoded the same way. Use printable ASCII characters without '%'
+// and ':' if a key must match a FileDescriptorName= of a socket unit
+// or a name in systemd's file descriptor store.
+func (a *App) SetListenerKey(s *http.Server, key string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if key == "" {
+		return errors.New("listener key is empty")
+	}
+	if other := a.findServerByKey(key); other != nil && other.s != s {
+		return fmt.Errorf("listener key %q is already used by server %v", key, other.s.Addr)
+	}
+	for _, as := range a.servers {
+		if as.s == s {
+			if as.l != nil {
+				return fmt.Errorf("server %v is already listening", s.Addr)
+			}
+			as.key = key
+			return nil
+		}
+	}
+	return fmt.Errorf("server %v has not been added", s.Addr)
+}
+
 // SetWaitChildTimeout sets the maximum amount of time for a parent
 // to wait for a child when activation is started. It is reset whenever
 // a new activation process is started.
@@ -104,141 +295,396 @@ func (a *App) SetWaitParentShutdownTimeout(d time.Duration) {
 	a.waitParentShutdownTimeout = d
 }
 
+// SetHeartbeatInterval sets an interval of heartbeats a child expects
+// from a parent while it waits for the parent shutdown. A heartbeat
+// carries the drain progress of the parent. A parent that misses
+// several heartbeats in a row is considered hung and is killed without
+// waiting for the rest of the parent shutdown timeout.
+//
+// Heartbeats are not sent by parents without the support of them.
+//
+// Default value is 5 seconds. 0 means no heartbeats.
+func (a *App) SetHeartbeatInterval(d time.Duration) {
+	a.heartbeatInterval = d
+}
+
+// AddServer adds a server to the app. If the app is already serving,
+// the server acquires one of the inherited listeners or creates a new
+// one and starts serving immediately.
+func (a *App) AddServer(s *http.Server) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.wasShutdown || a.started && !a.running {
+		return errAppNotServing
+	}
+	for _, as := range a.servers {
+		if as.s == s {
+			return fmt.Errorf("server %v has already been added", s.Addr)
+		}
+	}
+	as := newAppServer(s)
+	as.key = a.defaultListenerKey(s.Addr)
+	if a.running {
+		err := a.listen(as)
+		if err != nil {
+			return err
+		}
+		a.serve(as)
+	}
+	a.servers = append(a.servers, as)
+	return nil
+}
+
+// RemoveServer gracefully shuts down a server without interrupting any
+// active connections and removes it from the app. The server's listener
+// will not be passed to a child anymore.
+func (a *App) RemoveServer(s *http.Server) error {
+	a.mutex.Lock()
+	var as *appServer
+	for i := range a.servers {
+		if a.servers[i].s == s {
+			as = a.servers[i]
+			a.servers = append(a.servers[:i], a.servers[i+1:]...)
+			break
+		}
+	}
+	running := a.running
+	started := a.started
+	e := a.registry
+	var l *net.TCPListener
+	if as != nil {
+		l = as.l
+	}
+	a.mutex.Unlock()
+
+	if as == nil {
+		return fmt.Errorf("server %v has not been added", s.Addr)
+	}
+
+	// Drop the listener first. A child started during a drain must
+	// not get it. Its key is not reserved anymore.
+	if e != nil {
+		e.forgetKey(as.key)
+	}
+	if l != nil {
+		e.Release(l)
+		a.mutex.Lock()
+		a.unstoreListener(as)
+		a.mutex.Unlock()
+	}
+	if !running {
+		// Nobody serves the listener of a server removed before the
+		// start of serving.
+		if l != nil && !started {
+			l.Close()
+		}
+		return nil
+	}
+	err := a.shutdownServer(as)
+	if err != nil {
+		logger.Printf("server %s has been removed with: %v", s.Addr, err)
+		return err
+	}
+	logger.Printf("server %s has been removed", s.Addr)
+	return nil
+}
+
+// Addr returns the address a server is bound to or nil if the server
+// is not listening. It is useful for servers with ephemeral ports, e.g.
+// ":0". All servers are listening when PreServeFn is called.
+func (a *App) Addr(s *http.Server) net.Addr {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for _, as := range a.servers {
+		if as.s == s && as.l != nil {
+			return as.l.Addr()
+		}
+	}
+	return nil
+}
+
+// Addrs returns the addresses all servers are bound to in the order
+// they were added. An address is nil if a server is not listening.
+func (a *App) Addrs() []net.Addr {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	addrs := make([]net.Addr, len(a.servers))
+	for i, as := range a.servers {
+		if as.l != nil {
+			addrs[i] = as.l.Addr()
+		}
+	}
+	return addrs
+}
+
 // Shutdown gracefully shut downs all servers without interrupting any
-// active connections.
+// active connections. A supervisor shuts down its worker.
 func (a *App) Shutdown() {
+	// An incomplete handshake must not delay shutdown.
+	a.cancelHandshakes()
+
+	a.mutex.Lock()
+	supervisor := a.isSupervisor()
+	a.mutex.Unlock()
+	if supervisor {
+		a.shutdownSupervisor()
+		return
+	}
+
 	// Wait for all servers to start serving to avoid race conditions
 	// connected with shutdown. 'Shutdown' must be called only if server
 	// has already started or it does nothing.
 	a.shutdownSync.Lock()
 	defer a.shutdownSync.Unlock()
 
+	a.mutex.Lock()
 	if a.wasShutdown {
+		a.mutex.Unlock()
 		return
 	}
+	// No servers can be added since now.
+	a.wasShutdown = true
+	a.drainStart = time.Now()
+	a.running = false
+	a.setState(StateDraining)
+	servers := make([]*appServer, len(a.servers))
+	copy(servers, a.servers)
+	a.mutex.Unlock()
 
 	logger.Printf("shutdown servers...")
 	a.PreShutdownFn()
-	a.served.Wait()
+	for _, as := range servers {
+		as.served.Wait()
+	}
 
 	var wg sync.WaitGroup
-	wg.Add(len(a.servers))
+	wg.Add(len(servers))
 
 	// Shutdown all servers in parallel
-	for _, s := range a.servers {
-		go func(s *http.Server) {
+	for _, as := range servers {
+		go func(as *appServer) {
 			defer wg.Done()
-			err := s.Shutdown(context.Background())
+			err := a.shutdownServer(as)
 			if err != nil {
-				logger.Printf("server %s has been shutdown with: %v", s.Addr, err)
+				logger.Printf("server %s has been shutdown with: %v", as.s.Addr, err)
 				return
 			}
-			logger.Printf("server %s has been shutdown", s.Addr)
-		}(s)
+			logger.Printf("server %s has been shutdown", as.s.Addr)
+		}(as)
 	}
 
-	a.wasShutdown = true
+	stopReports := a.reportDrain()
 	wg.Wait()
+	stopReports()
 	a.CompleteShutdownFn()
+	close(a.done)
 }
 
 // ListenAndServe creates listeners for the given servers or reuses
 // the inherited ones. It also serves the servers and monitors OS
 // signals.
 func (a *App) ListenAndServe() error {
-	inherited, messenger, err := inherit()
+	a.mutex.Lock()
+	a.masterPID = masterFromEnv()
+	supervisor := a.isSupervisor()
+	a.mutex.Unlock()
+	if supervisor {
+		return a.supervise()
+	}
+
+	inherited, messenger, files, err := a.inherit()
 	if err != nil {
 		logger.Printf("failed to inherit listeners with: %v", err)
 		return err
 	}
-	e := newExchange(inherited)
+	err = a.lockPIDFile(files[pidLockFDName])
+	if err != nil {
+		logger.Printf("failed to lock pid file with: %v", err)
+		if messenger != nil {
+			messenger.Close()
+		}
+		return err
+	}
+	if f := files[supervisorFDName]; f != nil {
+		a.connectSupervisor(f)
+	}
+	e := newRegistry(inherited)
 	logger.Printf("serving with pid=%d, inherited=%s", os.Getpid(), formatInherited(e))
 
 	// Signals wait group.
 	var sigWG sync.WaitGroup
 	sigWG.Add(1)
 	sigCtx, sigCancelFunc := context.WithCancel(context.Background())
-	go a.handleSignals(sigCtx, &sigWG, e)
-
-	// Servers 'Listen' wait group.
-	var startWG sync.WaitGroup
-	startWG.Add(len(a.servers))
-	// Servers 'Serve' channel.
-	finishCh := make(chan error, len(a.servers))
-	// Waiting for parent wait group.
-	var parentWG sync.WaitGroup
-	parentWG.Add(1)
-
-	var startErr error
-
-	for _, s := range a.servers {
-		go func(s *http.Server) {
-			var err error
-			defer func() { finishCh <- err }()
-			// Make sure Shutdown is not blocked event if
-			// notifyListener.Accept() not call.
-			servedOnce := &doneOnce{wg: &a.served}
-			defer servedOnce.Done()
-			// Make sure startWG.Wait() is not blocked in case of error
-			// in acquireOrCreateListener.
-			startOnce := &doneOnce{wg: &startWG}
-			defer startOnce.Done()
-
-			l, err := e.acquireOrCreateListener("tcp", s.Addr)
-			if err != nil {
-				logger.Printf("failed to listen on %v with: %v", s.Addr, err)
-				return
-			}
-			// A server is about to Serve and already listen.
-			startOnce.Done()
-			// Wait for parent to start if set.
-			parentWG.Wait()
-			if startErr != nil {
-				logger.Printf("server %v exited with: %v", s.Addr, startErr)
-				return
-			}
-			// TODO: shutdown all servers in case of error
-			err = s.Serve(&notifyListener{Listener: tcpKeepAliveListener{l}, doneOnce: servedOnce})
-			if err == http.ErrServerClosed {
-				logger.Printf("server %v has finished serving", s.Addr)
-			} else {
-				logger.Printf("server %v has finished serving with: %v", s.Addr, err)
-			}
-		}(s)
+	go a.handleSignals(sigCtx, &sigWG)
+
+	// The first error stops all servers.
+	var finalErr error
+	var finalErrOnce sync.Once
+	fail := func(err error) {
+		finalErrOnce.Do(func() {
+			finalErr = err
+			sigCancelFunc()
+		})
 	}
 
-	// Wait for all listeners to start listening.
-	startWG.Wait()
+	// Create or acquire listeners for all servers.
+	a.mutex.Lock()
+	a.registry = e
+	a.failFn = fail
+	a.initGeneration()
+	// A child becomes an owner when it accepts the listeners.
+	a.owner = messenger == nil
+	a.writeStatusFile()
+	a.writePIDFile()
+	if a.owner {
+		err = a.listenControlSocket()
+		if err == nil {
+			err = a.listenRendezvousSocket()
+		}
+	}
+	for _, as := range a.servers {
+		e.expectKey(as.key)
+	}
+	for _, as := range a.servers {
+		if err != nil {
+			break
+		}
+		err = a.listen(as)
+	}
+	a.mutex.Unlock()
 
+	startErr := err
 	if messenger != nil {
-		startErr = protocolActAsChild(messenger, a.waitChildTimeout, a.waitParentShutdownTimeout, a.PreParentExitFn)
+		if startErr == nil {
+			startErr = protocolActAsChild(a.handshakeCtx, messenger, a.waitChildTimeout, a.waitParentShutdownTimeout, a.heartbeatInterval, func(drainingPIDs []int, shutdownPID int) {
+				a.takeOver(drainingPIDs, shutdownPID)
+				a.PreParentExitFn()
+			}, a.DrainReportFn)
+		} else {
+			// Let the parent know immediately.
+			messenger.Close()
+		}
 	}
 	if startErr == nil {
 		startErr = a.PreServeFn(e.didInherit())
 	}
 
-	// Allow serverse's goroutines to start serving.
-	parentWG.Done()
-
-	// Wait for all server's. They may fail or be stopped by calling Shutdown.
-	finalErr := startErr
-	if finalErr != nil {
-		sigCancelFunc()
-	}
-	for range a.servers {
-		err = <-finishCh
-		if finalErr == nil && err != nil && err != http.ErrServerClosed {
-			sigCancelFunc()
-			finalErr = err
+	// Start serving. Servers added during the start are listening
+	// here as well.
+	a.mutex.Lock()
+	for _, as := range a.servers {
+		if startErr == nil && as.l == nil {
+			startErr = a.listen(as)
 		}
+		if startErr != nil {
+			// Make sure Shutdown is not blocked.
+			as.servedOnce.Done()
+			continue
+		}
+		a.serve(as)
+	}
+	a.started = true
+	a.running = startErr == nil && !a.wasShutdown
+	if a.running {
+		a.setState(StateServing)
+	}
+	a.mutex.Unlock()
+
+	if startErr != nil {
+		logger.Printf("failed to start serving with: %v", startErr)
+		fail(startErr)
 	}
+
+	// Wait for the shutdown and for all server's. They may fail or be
+	// stopped by calling Shutdown.
+	<-a.done
+	a.serving.Wait()
 	sigCancelFunc()
 	sigWG.Wait()
 
+	a.mutex.Lock()
+	a.setState(StateStopped)
+	a.removePIDFile()
+	a.closeControlSocket()
+	a.closeRendezvousSocket()
+	if a.supervisorConn != nil {
+		a.supervisorConn.Close()
+	}
+	a.mutex.Unlock()
+	// Let control commands in progress send their replies and a child
+	// get the shutdown confirmation.
+	a.controlWG.Wait()
+	a.handshakeWG.Wait()
+	a.syncStatusFile()
+
 	return finalErr
 }
 
-func (a *App) handleSignals(ctx context.Context, wg *sync.WaitGroup, e *exchange) {
+// listen acquires an inherited listener or creates a new one for the
+// given server. It must be called with mutex held.
+func (a *App) listen(as *appServer) error {
+	l, err := a.registry.Listen(as.key, "tcp", as.s.Addr)
+	if err != nil {
+		logger.Printf("failed to listen on %v with: %v", as.s.Addr, err)
+		return err
+	}
+	as.l = l
+	a.storeListener(as)
+	return nil
+}
+
+// serve starts serving a listening server in a separate goroutine.
+// It must be called with mutex held.
+func (a *App) serve(as *appServer) {
+	as.s.ConnState = as.conns.track(as.s.ConnState)
+	as.s.BaseContext = withGeneration(as.s.BaseContext, a.generationInfo)
+	as.stopped = make(chan struct{})
+	a.serving.Add(1)
+	go func() {
+		defer a.serving.Done()
+		defer close(as.stopped)
+		// Make sure Shutdown is not blocked event if
+		// notifyListener.Accept() not call.
+		defer as.servedOnce.Done()
+
+		s := as.s
+		err := s.Serve(&notifyListener{Listener: tcpKeepAliveListener{as.l}, doneOnce: as.servedOnce})
+		a.mutex.Lock()
+		closed := as.closed
+		a.mutex.Unlock()
+		if err == http.ErrServerClosed || closed {
+			logger.Printf("server %v has finished serving", s.Addr)
+			return
+		}
+		logger.Printf("server %v has finished serving with: %v", s.Addr, err)
+		a.failFn(err)
+	}()
+}
+
+// shutdownServer gracefully shuts down a server. http.Server closes a
+// connection accepted during Shutdown without a response if a request
+// has not been read yet. So the listener is closed first and just
+// accepted connections get some time to read their requests.
+func (a *App) shutdownServer(as *appServer) error {
+	as.served.Wait()
+	a.mutex.Lock()
+	stopped := as.stopped
+	as.closed = stopped != nil
+	a.mutex.Unlock()
+
+	if stopped != nil {
+		// Serve returns as soon as the listener is closed.
+		as.l.Close()
+		<-stopped
+		as.conns.waitNew(newConnTimeout)
+	}
+	return as.s.Shutdown(context.Background())
+}
+
+func (a *App) handleSignals(ctx context.Context, wg *sync.WaitGroup) {
 	defer logger.Printf("stop handling signals")
 	defer wg.Done()
 
@@ -246,7 +692,19 @@ func (a *App) handleSignals(ctx context.Context, wg *sync.WaitGroup, e *exchange
 	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR2)
 	defer signal.Stop(signals)
 
-CatchSignals:
+	// Restarts and shutdowns are running in parallel with signal
+	// handling. It allows to apply restart policy to signals that
+	// arrive during a restart and to force a shutdown in progress.
+	var bgWG sync.WaitGroup
+	defer bgWG.Wait()
+	background := func(fn func()) {
+		bgWG.Add(1)
+		go func() {
+			defer bgWG.Done()
+			fn()
+		}()
+	}
+
 	for {
 		select {
 		// Exit.
@@ -261,41 +719,38 @@ CatchSignals:
 			switch s {
 			// Shutdown servers. No exit here.
 			case syscall.SIGINT, syscall.SIGTERM:
-				a.Shutdown()
+				background(a.Shutdown)
 			// Fork/Exec a child and shutdown.
 			case syscall.SIGUSR2:
-				_, f, err := forkExec(e.activeFiles())
-				if err != nil {
-					logger.Printf("failed to forkExec: %v", err)
-					continue CatchSignals
-				}
-				m, err := ListenSocket(f)
-				if err != nil {
-					logger.Printf("failed to listen communication socket: %v", err)
-					continue CatchSignals
-				}
-				// Nothing to do with errors.
-				protocolActAsParent(m, a.waitChildTimeout, a.waitParentShutdownTimeout, func() {
-					a.Shutdown()
+				background(func() {
+					// Nothing to do with errors.
+					a.restart(RestartOptions{Reason: s.String()}, TriggerSignal)
 				})
 			}
 		}
 	}
 }
 
-// forkExec starts another process of yourself and passes the active
-// listeners to a child to perform socket activation.
-func forkExec(files []*os.File) (int, *os.File, error) {
-	// Get the path name for the executable that started the current process.
-	path, err := os.Executable()
+// forkExec starts another process of yourself and passes the given
+// files to a child to perform socket activation. Names travel with
+// the files. Extra files are passed after them. A binary and arguments
+// may be overridden with opts.
+func (a *App) forkExec(opts RestartOptions, files []*os.File, names []string, extra []extraFile, extraEnv []string) (int, *os.File, error) {
+	path, args, err := restartCommand(opts)
 	if err != nil {
 		return -1, nil, err
 	}
-	// @TODO: remove
-	// Fix the path name after the evaluation of any symbolic links.
-	path, err = filepath.EvalSymlinks(path)
-	if err != nil {
-		return -1, nil, err
+	// The exec helper starts the binary instead of us.
+	a.mutex.Lock()
+	helper := a.execHelper
+	a.mutex.Unlock()
+	execPath := ""
+	if helper {
+		execPath = path
+		path, err = selfExecutable()
+		if err != nil {
+			return -1, nil, err
+		}
 	}
 
 	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
@@ -304,29 +759,92 @@ func forkExec(files []*os.File) (int, *os.File, error) {
 	}
 	f0 := os.NewFile(uintptr(fds[0]), "s|0")
 	f1 := os.NewFile(uintptr(fds[1]), "s|1")
+	// A communication socket is always the last one.
 	files = append(files, f1)
+	names = append(names, messengerFDName)
+
+	env := append(prepareEnv(names), extraEnv...)
+	if execPath != "" {
+		env = append(env, execHelperEnv(execPath))
+	}
+	procFiles := append([]*os.File{os.Stdin, os.Stdout, os.Stderr}, files...)
+	for _, ef := range extra {
+		env = append(env, fmt.Sprintf("%s=%d", ef.env, len(procFiles)))
+		procFiles = append(procFiles, ef.f)
+	}
+	// os.StartProcess would put the listeners into blocking mode (read
+	// 'A Lyrical Digression' in file_listener.go).
+	procFDs := make([]uintptr, len(procFiles))
+	for i, f := range procFiles {
+		var fd int
+		fd, err = fileFD(f)
+		if err != nil {
+			break
+		}
+		procFDs[i] = uintptr(fd)
+	}
 
 	// Start the original executable with the original working directory.
-	process, err := os.StartProcess(path, os.Args, &os.ProcAttr{
-		Dir:   originalWD,
-		Env:   prepareEnv(len(files)),
-		Files: append([]*os.File{os.Stdin, os.Stdout, os.Stderr}, files...),
-	})
+	pid := -1
+	if err == nil {
+		pid, _, err = syscall.StartProcess(path, args, &syscall.ProcAttr{
+			Dir:   originalWD,
+			Env:   env,
+			Files: procFDs,
+		})
+		if err != nil {
+			err = &os.PathError{Op: "fork/exec", Path: path, Err: err}
+		}
+	}
+	runtime.KeepAlive(procFiles)
+	// The child's end is not needed anymore. Closing it allows to
+	// detect the child's death.
+	f1.Close()
 	if err != nil {
+		f0.Close()
 		return -1, nil, err
 	}
 
-	return process.Pid, f0, nil
+	return pid, f0, nil
+}
+
+// restartCommand returns a path and arguments of a process to start.
+func restartCommand(opts RestartOptions) (string, []string, error) {
+	path := opts.Path
+	if path == "" {
+		// Get the path name for the executable that started the current process.
+		var err error
+		path, err = os.Executable()
+		if err != nil {
+			return "", nil, err
+		}
+	} else if !filepath.IsAbs(path) {
+		path = filepath.Join(originalWD, path)
+	}
+	// @TODO: remove
+	// Fix the path name after the evaluation of any symbolic links.
+	path, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", nil, err
+	}
+	args := os.Args
+	if opts.Args != nil {
+		args = append([]string{path}, opts.Args...)
+	}
+	return path, args, nil
 }
 
 // formatInherited prints info about inherited listeners to a string.
-func formatInherited(e *exchange) string {
+func formatInherited(e *Registry) string {
 	result := "["
 	for i, pr := range e.inherited {
 		if i != 0 {
 			result += ", "
 		}
 		result += fmt.Sprintf("%v", pr.l.Addr())
+		if pr.name != "" {
+			result += fmt.Sprintf("(%s)", pr.name)
+		}
 	}
 	result += "]"
 	return result
@@ -334,13 +852,44 @@ func formatInherited(e *exchange) string {
 
 type readyMsg struct {
 	WaitParentShutdownTimeout time.Duration
+	// A range of handshake protocol versions the child speaks and its
+	// capabilities. A 0.1 child sends no version.
+	ProtocolVersion    int
+	MinProtocolVersion int
+	Capabilities       []string
+	// An interval of heartbeats the child expects, 0 if none.
+	HeartbeatInterval time.Duration
 }
 
 type readyConfirmationMsg struct {
+	// The version chosen by the parent and the capabilities both peers
+	// have. A 0.1 parent sends no version.
+	ProtocolVersion int
+	Capabilities    []string
+	// Error is set if the parent can't continue the handshake. Other
+	// fields are not set in this case.
+	Error string
+
 	FixedWaitParentShutdownTimeout time.Duration
+	// PIDs of the parent's ancestors that are still draining.
+	DrainingPIDs []int
+	// PID of a process the child replaces. It is killed if it does
+	// not shutdown in time. The parent if 0, nobody if negative.
+	ShutdownPID int
+	// An interval of heartbeats the parent sends while it is shutting
+	// down, 0 if none.
+	HeartbeatInterval time.Duration
 }
 
 type acceptedMsg struct {
+	// Error is set if the child does not accept the listeners. The
+	// parent keeps serving in this case.
+	Error string
+}
+
+// heartbeatMsg is sent by a parent while it is shutting down.
+type heartbeatMsg struct {
+	Report DrainReport
 }
 
 type shutdownConfirmationMsg struct {
@@ -352,6 +901,10 @@ const (
 	// Socket buffer is big enough to keep our micro messages. So there
 	// is no need to use long timeouts.
 	sendTimeout = time.Second * 20
+
+	// A parent that misses this number of heartbeats in a row is
+	// considered hung.
+	heartbeatMisses = 3
 )
 
 func maxTimeout(l time.Duration, r time.Duration) time.Duration {
@@ -361,23 +914,58 @@ func maxTimeout(l time.Duration, r time.Duration) time.Duration {
 	return r
 }
 
-func protocolActAsParent(m *StreamMessenger, waitChildTimeout time.Duration, waitParentShutdownTimeout time.Duration, shutdownFn func()) error {
+func protocolActAsParent(ctx context.Context, m *StreamMessenger, waitChildTimeout time.Duration, waitParentShutdownTimeout time.Duration, drainingPIDs []int, shutdownPID int, reportFn func() DrainReport, shutdownFn func()) error {
 	defer m.Close()
+	m.SetFrameVersion(FrameV1)
 	// Set deadline for ready/confirmation.
-	m.SetDeadline(time.Now().Add(waitChildTimeout))
+	readyCtx, cancel := context.WithTimeout(ctx, waitChildTimeout)
+	defer cancel()
 
 	logger.Printf("parent<-child: waiting for readyMsg...")
 	r := readyMsg{}
-	err := m.Recv(&r)
+	err := m.RecvContext(readyCtx, &r)
 	if err != nil {
 		logger.Printf("parent<-child failed with: %v", err)
 		// The child will die by timout.
 		return err
 	}
 
+	remote := protocolOffer{r.ProtocolVersion, r.MinProtocolVersion, r.Capabilities}
+	p, perr := negotiateProtocol(localProtocol, remote)
+	// Any child shuts the parent down, so the capability is needed
+	// to shutdown another process only.
+	if perr == nil && shutdownPID > 0 && shutdownPID != os.Getpid() && !p.has(capShutdownPID) {
+		perr = &ProtocolError{fmt.Sprintf("the child can't shutdown pid %d instead of the parent", shutdownPID)}
+	}
+	if perr != nil {
+		logger.Printf("parent<-child failed with: %v", perr)
+		// A 0.1 child takes any confirmation as a success. It fails
+		// when the socket is closed.
+		if r.ProtocolVersion >= protocolV2 {
+			sendWithTimeout(readyCtx, m, sendTimeout, readyConfirmationMsg{Error: perr.Reason})
+		}
+		return perr
+	}
+	logger.Printf("parent: negotiated protocol v%d with capabilities %v", p.Version, p.Capabilities)
+	if p.has(capFrameV2) {
+		m.SetFrameVersion(FrameV2)
+	}
+
 	logger.Printf("parent->child: sending readyConfirmationMsg...")
 	tipTimeout := maxTimeout(r.WaitParentShutdownTimeout, waitParentShutdownTimeout)
-	err = m.Send(readyConfirmationMsg{FixedWaitParentShutdownTimeout: tipTimeout})
+	// Heartbeats make sense only if the child waits for the shutdown.
+	heartbeatInterval := time.Duration(0)
+	if p.has(capHeartbeat) && p.has(capFrameV2) && reportFn != nil && tipTimeout != 0 {
+		heartbeatInterval = r.HeartbeatInterval
+	}
+	err = m.SendContext(readyCtx, readyConfirmationMsg{
+		ProtocolVersion:                p.Version,
+		Capabilities:                   p.Capabilities,
+		FixedWaitParentShutdownTimeout: tipTimeout,
+		DrainingPIDs:                   drainingPIDs,
+		ShutdownPID:                    shutdownPID,
+		HeartbeatInterval:              heartbeatInterval,
+	})
 	if err != nil {
 		logger.Printf("parent->child failed with: %v", err)
 		// The child will die by timout.
@@ -390,32 +978,45 @@ func protocolActAsParent(m *StreamMessenger, waitChildTimeout time.Duration, wai
 
 	logger.Printf("parent<-child: waiting for acceptedMsg...")
 	a := acceptedMsg{}
-	err = m.Recv(&a)
+	err = m.RecvContext(readyCtx, &a)
 	if err != nil {
 		logger.Printf("parent<-child failed with: %v", err)
 	}
+	if a.Error != "" {
+		err = &ProtocolError{a.Error}
+		logger.Printf("parent<-child failed with: %v", err)
+		return err
+	}
 
 	// Shutdown callback.
+	stopHeartbeats := sendHeartbeats(m, heartbeatInterval, reportFn)
 	shutdownFn()
+	stopHeartbeats()
 
 	if tipTimeout == 0 {
 		return nil
 	}
+	// The parent is shutting down, the confirmation is sent anyway.
 	logger.Printf("parent->child: sending shutdownConfirmationMsg...")
-	m.SetDeadline(time.Now().Add(sendTimeout))
-	err = m.Send(shutdownConfirmationMsg{})
+	err = sendWithTimeout(context.Background(), m, sendTimeout, shutdownConfirmationMsg{})
 	if err != nil {
 		logger.Printf("parent->child failed with: %v", err)
 	}
 	return nil
 }
 
-func protocolActAsChild(m *StreamMessenger, waitChildTimeout time.Duration, waitParentShutdownTimeout time.Duration, notifyFn func()) error {
+func protocolActAsChild(ctx context.Context, m *StreamMessenger, waitChildTimeout time.Duration, waitParentShutdownTimeout time.Duration, heartbeatInterval time.Duration, notifyFn func(drainingPIDs []int, shutdownPID int), reportFn func(DrainReport)) error {
 	defer m.Close()
+	m.SetFrameVersion(FrameV1)
 
 	logger.Printf("child->parent: sending readyMsg to the parent...")
-	m.SetDeadline(time.Now().Add(sendTimeout))
-	err := m.Send(readyMsg{WaitParentShutdownTimeout: waitParentShutdownTimeout})
+	err := sendWithTimeout(ctx, m, sendTimeout, readyMsg{
+		WaitParentShutdownTimeout: waitParentShutdownTimeout,
+		ProtocolVersion:           localProtocol.Version,
+		MinProtocolVersion:        localProtocol.MinVersion,
+		Capabilities:              localProtocol.Capabilities,
+		HeartbeatInterval:         heartbeatInterval,
+	})
 	if err != nil {
 		logger.Printf("child->parent failed with: %v", err)
 		return err
@@ -423,22 +1024,47 @@ func protocolActAsChild(m *StreamMessenger, waitChildTimeout time.Duration, wait
 
 	logger.Printf("child<-parent: waiting for readyConfirmationMsg...")
 	rcr := readyConfirmationMsg{}
-	m.SetDeadline(time.Now().Add(maxTimeout(waitChildTimeout, waitParentShutdownTimeout)))
-	err = m.Recv(&rcr)
+	err = recvWithTimeout(ctx, m, maxTimeout(waitChildTimeout, waitParentShutdownTimeout), &rcr)
 	if err != nil {
 		logger.Printf("child<-parent failed with: %v", err)
 		return err
 	}
+	if rcr.Error != "" {
+		err = &ProtocolError{rcr.Error}
+		logger.Printf("child<-parent failed with: %v", err)
+		return err
+	}
+	version := rcr.ProtocolVersion
+	if version == 0 {
+		version = protocolV1
+	}
+	if !localProtocol.normalize().accepts(version) {
+		reason := fmt.Sprintf("the parent has chosen unsupported version %d", version)
+		logger.Printf("child<-parent failed with: %v", reason)
+		// A 0.1 parent takes any message as an acceptance.
+		if version >= protocolV2 {
+			sendWithTimeout(ctx, m, sendTimeout, acceptedMsg{Error: reason})
+		}
+		return &ProtocolError{reason}
+	}
+	logger.Printf("child: negotiated protocol v%d with capabilities %v", version, rcr.Capabilities)
+	if (protocolOffer{Capabilities: rcr.Capabilities}).has(capFrameV2) {
+		m.SetFrameVersion(FrameV2)
+	}
 
 	//
 	// Ball is in our court now. The parent must die.
 	//
 
-	notifyFn()
+	shutdownPID := rcr.ShutdownPID
+	if shutdownPID == 0 {
+		shutdownPID = os.Getppid()
+	}
+	notifyFn(rcr.DrainingPIDs, shutdownPID)
 
+	// The listeners are accepted, the parent must know it anyway.
 	logger.Printf("child->parent: sending acceptedMsg...")
-	m.SetDeadline(time.Now().Add(sendTimeout))
-	err = m.Send(acceptedMsg{})
+	err = sendWithTimeout(context.Background(), m, sendTimeout, acceptedMsg{})
 	if err != nil {
 		logger.Printf("child->parent failed with: %v", err)
 	}
@@ -448,27 +1074,102 @@ func protocolActAsChild(m *StreamMessenger, waitChildTimeout time.Duration, wait
 	}
 
 	logger.Printf("child<-parent: waiting for shutdownConfirmationMsg...")
-	scr := shutdownConfirmationMsg{}
-	m.SetDeadline(time.Now().Add(rcr.FixedWaitParentShutdownTimeout))
-	err = m.Recv(&scr)
+	err = waitParentShutdown(ctx, m, rcr.FixedWaitParentShutdownTimeout, rcr.HeartbeatInterval, reportFn)
 	if err != nil {
 		logger.Printf("child<-parent failed with: %v", err)
-		if opErr, ok := err.(*net.OpError); ok {
-			if opErr.Timeout() {
-				// There are issues on parent's side probably.
-				// Need to kill parent.
-				parentPID, err := killParent()
-				logger.Printf("parent %d was killed with: %v", parentPID, err)
-				return nil
-			}
+		if err == context.DeadlineExceeded && shutdownPID > 0 {
+			// There are issues on parent's side probably.
+			// Need to kill parent.
+			parentPID, err := killProcess(shutdownPID)
+			logger.Printf("parent %d was killed with: %v", parentPID, err)
+			return nil
 		}
 		return err
 	}
 	return nil
 }
 
-func killParent() (parentPID int, err error) {
-	return killProcess(os.Getppid())
+// sendHeartbeats sends heartbeats with the drain progress until the
+// returned function is called. Nothing is sent if interval is 0.
+func sendHeartbeats(m *StreamMessenger, interval time.Duration, reportFn func() DrainReport) func() {
+	if interval <= 0 {
+		return func() {}
+	}
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+			}
+			// The parent is shutting down, heartbeats are sent anyway.
+			err := sendWithTimeout(context.Background(), m, sendTimeout, heartbeatMsg{reportFn()})
+			if err != nil {
+				logger.Printf("parent->child failed with: %v", err)
+				return
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-stopped
+	}
+}
+
+// waitParentShutdown waits for shutdownConfirmationMsg. If the parent
+// sends heartbeats, it returns context.DeadlineExceeded as soon as
+// several heartbeats in a row are missed.
+func waitParentShutdown(ctx context.Context, m *StreamMessenger, timeout time.Duration, heartbeatInterval time.Duration, reportFn func(DrainReport)) error {
+	if heartbeatInterval <= 0 {
+		return recvWithTimeout(ctx, m, timeout, &shutdownConfirmationMsg{})
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		wait := time.Until(deadline)
+		missed := wait > heartbeatInterval*heartbeatMisses
+		if missed {
+			wait = heartbeatInterval * heartbeatMisses
+		}
+		hb := heartbeatMsg{}
+		err := recvWithTimeout(ctx, m, wait, &hb)
+		if e, ok := err.(*UnexpectedMessageError); ok && e.Received == shutdownConfirmationMsgType {
+			// The confirmation is empty, nothing is lost.
+			return nil
+		}
+		if err == context.DeadlineExceeded && missed {
+			logger.Printf("child<-parent: %d heartbeats in a row are missed", heartbeatMisses)
+		}
+		if err != nil {
+			return err
+		}
+		logDrainReport(hb.Report)
+		if reportFn != nil {
+			reportFn(hb.Report)
+		}
+	}
+}
+
+// sendWithTimeout sends a message with a timeout that is applied in
+// addition to ctx.
+func sendWithTimeout(ctx context.Context, m *StreamMessenger, d time.Duration, v interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, d)
+	defer cancel()
+
+	return m.SendContext(ctx, v)
+}
+
+// recvWithTimeout receives a message with a timeout that is applied in
+// addition to ctx.
+func recvWithTimeout(ctx context.Context, m *StreamMessenger, d time.Duration, v interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, d)
+	defer cancel()
+
+	return m.RecvContext(ctx, v)
 }
 
 func killProcess(pid int) (parentPID int, err error) {
@@ -7,14 +7,18 @@
 package zerodt
 
 import (
+	"bufio"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 	"sync"
 	"sync/atomic"
@@ -49,6 +53,7 @@ type run struct {
 	swg       sync.WaitGroup
 	client    *http.Client
 	port      string
+	args      []string
 }
 
 func newRun(t *testing.T, port int) *run {
@@ -69,6 +74,7 @@ func (d *run) start(waitForParent bool) {
 	if waitForParent {
 		args = append(args, "-waitForParent")
 	}
+	args = append(args, d.args...)
 
 	// Start an http server.
 	cmd := exec.Command(os.Args[0], args...)
@@ -198,6 +204,48 @@ func (d *run) restart() {
 	d.waitForProcess(false)
 }
 
+func (d *run) generation() GenerationInfo {
+	r, err := d.client.Get("http://localhost:" + d.port + "/generation")
+	require.NoError(d.t, err)
+	defer r.Body.Close()
+	info := GenerationInfo{}
+	require.NoError(d.t, json.NewDecoder(r.Body).Decode(&info))
+	return info
+}
+
+// listenPID returns LISTEN_PID a process has been started with.
+func (d *run) listenPID() string {
+	r, err := d.client.Get("http://localhost:" + d.port + "/listenpid")
+	require.NoError(d.t, err)
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	require.NoError(d.t, err)
+	return string(body)
+}
+
+func (d *run) addrs() []string {
+	r, err := d.client.Get("http://localhost:" + d.port + "/addrs")
+	require.NoError(d.t, err)
+	defer r.Body.Close()
+	addrs := []string{}
+	require.NoError(d.t, json.NewDecoder(r.Body).Decode(&addrs))
+	return addrs
+}
+
+// waitForStatus polls the status of an app over its control socket
+// until fn accepts it.
+func waitForStatus(t *testing.T, path string, fn func(st *Status) bool) *Status {
+	for i := 0; i < 300; i++ {
+		reply, err := SendControlCommand(path, ControlRequest{Command: ControlStatus}, time.Second*5)
+		if err == nil && reply.Status != nil && fn(reply.Status) {
+			return reply.Status
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	t.Fatal("status is not reached")
+	return nil
+}
+
 func (d *run) lastProcess() *os.Process {
 	l := len(d.processes)
 	require.NotEmpty(d.t, l)
@@ -291,6 +339,307 @@ func TestTrippleRestartStateless(t *testing.T) {
 	require.Equal(t, 1, <-ch)
 }
 
+func TestMaxDrainingGenerations(t *testing.T) {
+	d := newRun(t, 2609)
+	d.args = []string{"-maxDraining", "1"}
+
+	d.start(false)
+	// The first generation is killed while handling this request. A
+	// request on a new connection is not retried by the client.
+	d.swg.Add(1)
+	go func() {
+		defer d.swg.Done()
+		client := http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+		_, err := client.Get(fmt.Sprintf("http://localhost:%s/sleep?duration=5000ms", d.port))
+		assert.Error(t, err)
+	}()
+	time.Sleep(time.Millisecond * 100)
+	d.restart()
+	// The second generation keeps handling this request.
+	d.swg.Add(1)
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	go sendMessage(t, &d.swg, client, d.port, 3000, 0, d.lastProcess().Pid)
+	time.Sleep(time.Millisecond * 100)
+	d.restart()
+
+	// Only the oldest draining generation is killed.
+	state, err := d.processes[0].Wait()
+	require.NoError(t, err)
+	ws, ok := state.Sys().(syscall.WaitStatus)
+	require.True(t, ok)
+	assert.True(t, ws.Signaled())
+	assert.Equal(t, syscall.SIGKILL, ws.Signal())
+	assert.NoError(t, d.processes[1].Signal(syscall.Signal(0)))
+
+	d.stop()
+	d.wait()
+}
+
+func TestPIDFileRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zerodt-pid-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.pid")
+
+	d := newRun(t, 2610)
+	d.args = []string{"-pidFile", path}
+
+	d.start(false)
+	assert.Equal(t, d.lastProcess().Pid, readPIDFile(path))
+	d.restart()
+	assert.Equal(t, d.lastProcess().Pid, readPIDFile(path))
+	d.stop()
+	d.wait()
+
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(path + ".lock")
+	assert.NoError(t, err)
+}
+
+func TestControlSocketRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zerodt-control-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.sock")
+
+	d := newRun(t, 2611)
+	d.args = []string{"-controlSocket", path}
+
+	d.start(false)
+	parent := d.lastProcess().Pid
+	req := ControlRequest{Command: ControlRestart, Restart: RestartOptions{Reason: "test"}}
+	reply, err := SendControlCommand(path, req, time.Second*30)
+	require.NoError(t, err)
+	require.Empty(t, reply.Error)
+	require.NotNil(t, reply.Status.LastRestart)
+	// The reply is sent once the child has accepted the listeners.
+	assert.Equal(t, StateDraining, reply.Status.State)
+	d.waitForProcess(false)
+	assert.Equal(t, d.lastProcess().Pid, reply.Status.LastRestart.ChildPID)
+	assert.Equal(t, 2, reply.Status.LastRestart.Generation)
+	assert.Equal(t, TriggerControl, reply.Status.LastRestart.Trigger)
+
+	// The child knows how it has been started.
+	info := d.generation()
+	assert.Equal(t, 2, info.Generation)
+	assert.Equal(t, parent, info.ParentPID)
+	assert.Equal(t, TriggerControl, info.Trigger)
+	assert.Equal(t, "test", info.Reason)
+
+	// The child has taken the socket over.
+	reply, err = SendControlCommand(path, ControlRequest{Command: ControlStatus}, time.Second*5)
+	require.NoError(t, err)
+	assert.Equal(t, d.lastProcess().Pid, reply.Status.PID)
+	assert.Equal(t, 2, reply.Status.Generation)
+	require.NotNil(t, reply.Status.LastRestart)
+	assert.Equal(t, d.lastProcess().Pid, reply.Status.LastRestart.ChildPID)
+	assert.Equal(t, 2, reply.Status.LastRestart.Generation)
+	assert.Equal(t, TriggerControl, reply.Status.LastRestart.Trigger)
+	assert.Equal(t, "test", reply.Status.LastRestart.Reason)
+
+	reply, err = SendControlCommand(path, ControlRequest{Command: ControlShutdown}, time.Second*5)
+	require.NoError(t, err)
+	assert.Empty(t, reply.Error)
+	require.NotNil(t, reply.Status)
+	assert.Equal(t, d.lastProcess().Pid, reply.Status.PID)
+	d.wait()
+
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSupervisorRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zerodt-supervisor-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.pid")
+
+	socket := filepath.Join(dir, "app.sock")
+
+	d := newRun(t, 2612)
+	d.args = []string{"-supervisor", "-pidFile", path, "-controlSocket", socket}
+
+	d.start(false)
+	master := readPIDFile(path)
+	require.NotZero(t, master)
+	assert.NotEqual(t, master, d.lastProcess().Pid)
+	d.send()
+	// A worker forwards a restart to the supervisor with its trigger
+	// and reason.
+	r, err := d.client.Get("http://localhost:" + d.port + "/restart?reason=test")
+	require.NoError(t, err)
+	r.Body.Close()
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+	d.waitForProcess(false)
+	d.send()
+	info := d.generation()
+	assert.Equal(t, TriggerAPI, info.Trigger)
+	assert.Equal(t, "test", info.Reason)
+	// Let the first restart finish, otherwise the next one is
+	// coalesced with it.
+	st := waitForStatus(t, socket, func(st *Status) bool {
+		return st.Generation == 2 && st.State == StateServing
+	})
+	require.NotNil(t, st.LastRestart)
+	assert.Equal(t, TriggerAPI, st.LastRestart.Trigger)
+	assert.Equal(t, "test", st.LastRestart.Reason)
+
+	p, err := os.FindProcess(master)
+	require.NoError(t, err)
+	require.NoError(t, p.Signal(syscall.SIGUSR2))
+	d.waitForProcess(false)
+	assert.Equal(t, master, readPIDFile(path))
+	assert.Len(t, d.processes, 3)
+
+	waitForStatus(t, socket, func(st *Status) bool {
+		return st.Generation == 3 && st.State == StateServing
+	})
+	require.NoError(t, p.Signal(syscall.SIGTERM))
+	d.wait()
+
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSupervisorRespawn(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zerodt-supervisor-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.pid")
+
+	socket := filepath.Join(dir, "app.sock")
+
+	d := newRun(t, 2613)
+	d.args = []string{"-supervisor", "-pidFile", path, "-controlSocket", socket}
+
+	d.start(false)
+	master := readPIDFile(path)
+	require.NotZero(t, master)
+	// The supervisor respawns a crashed worker.
+	require.NoError(t, d.lastProcess().Kill())
+	d.waitForProcess(true)
+	assert.Equal(t, master, readPIDFile(path))
+	d.send()
+
+	waitForStatus(t, socket, func(st *Status) bool {
+		return st.State == StateServing && st.WorkerCrashes == 1
+	})
+	p, err := os.FindProcess(master)
+	require.NoError(t, err)
+	require.NoError(t, p.Signal(syscall.SIGTERM))
+	d.wait()
+}
+
+func TestPreforkRollingRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zerodt-prefork-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.sock")
+
+	d := newRun(t, 2614)
+	d.args = []string{"-prefork", "2", "-controlSocket", path}
+
+	d.start(false)
+	// A worker serves before the supervisor has started the others.
+	st := waitForStatus(t, path, func(st *Status) bool {
+		return st.State == StateServing
+	})
+	before := st.Workers
+	require.Len(t, before, 2)
+	for _, ws := range before {
+		assert.Equal(t, StateServing, ws.State)
+		assert.Equal(t, 1, ws.Generation)
+	}
+	assert.NotEqual(t, before[0].PID, before[1].PID)
+
+	// Any of the workers may handle a request.
+	r, err := d.client.Get("http://localhost:" + d.port)
+	require.NoError(t, err)
+	r.Body.Close()
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+
+	reply, err := SendControlCommand(path, ControlRequest{Command: ControlRestart}, time.Second*30)
+	require.NoError(t, err)
+	require.Empty(t, reply.Error)
+	assert.Equal(t, 2, reply.Status.Generation)
+	require.NotNil(t, reply.Status.LastRestart)
+	assert.Equal(t, 2, reply.Status.LastRestart.Generation)
+	after := reply.Status.Workers
+	require.Len(t, after, 2)
+	for i, ws := range after {
+		assert.Equal(t, StateServing, ws.State)
+		assert.Equal(t, 2, ws.Generation)
+		assert.Equal(t, 1, ws.Restarts)
+		assert.NotEqual(t, before[i].PID, ws.PID)
+	}
+
+	reply, err = SendControlCommand(path, ControlRequest{Command: ControlShutdown}, time.Second*5)
+	require.NoError(t, err)
+	d.wait()
+}
+
+func TestRendezvousRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zerodt-rendezvous-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.sock")
+
+	d := newRun(t, 2615)
+	d.args = []string{"-rendezvousSocket", path}
+
+	d.start(false)
+	first := d.lastProcess().Pid
+	d.send()
+	// The second process is not a child of the first one. It receives
+	// the listeners over the rendezvous socket.
+	d.start(false)
+	d.send()
+	info := d.generation()
+	assert.Equal(t, 2, info.Generation)
+	assert.Equal(t, first, info.ParentPID)
+	assert.Equal(t, TriggerRendezvous, info.Trigger)
+
+	d.stop()
+	d.wait()
+
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestStrictListenPIDRestart(t *testing.T) {
+	d := newRun(t, 2616)
+	d.args = []string{"-strictListenPID", "-execHelper"}
+
+	// A child started via the exec helper gets its real pid.
+	d.start(false)
+	d.send()
+	assert.Equal(t, "", d.listenPID())
+	for i := 0; i < 2; i++ {
+		d.restart()
+		d.send()
+		assert.Equal(t, strconv.Itoa(d.lastProcess().Pid), d.listenPID())
+	}
+	d.stop()
+	d.wait()
+}
+
+func TestEphemeralPortRestart(t *testing.T) {
+	d := newRun(t, 2617)
+	d.args = []string{"-ephemeral"}
+
+	d.start(false)
+	before := d.addrs()
+	require.Len(t, before, 2)
+	assert.NotContains(t, before[1], ":0")
+	d.restart()
+	d.restart()
+	// The child acquires the listener with the ephemeral port.
+	assert.Equal(t, before, d.addrs())
+	d.stop()
+	d.wait()
+}
+
 func TestKillParent(t *testing.T) {
 	d := newRun(t, 2608)
 	d.start(true)
@@ -302,6 +651,125 @@ func TestKillParent(t *testing.T) {
 	assert.EqualValues(t, syscall.ECHILD, underlyingError(err).(syscall.Errno))
 }
 
+// serveApp runs an app in the test process and waits until it is
+// serving. The result of ListenAndServe is sent to the channel.
+func serveApp(t *testing.T, a *App) chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- a.ListenAndServe()
+	}()
+	for i := 0; a.State() != StateServing; i++ {
+		require.True(t, i < 500, "app is not serving")
+		time.Sleep(time.Millisecond * 10)
+	}
+	return done
+}
+
+func TestAddRemoveServer(t *testing.T) {
+	a := NewApp(&http.Server{Addr: "127.0.0.1:0", Handler: http.HandlerFunc(root)})
+	done := serveApp(t, a)
+
+	s := &http.Server{Addr: "127.0.0.1:0", Handler: http.HandlerFunc(root)}
+	require.NoError(t, a.AddServer(s))
+	assert.Error(t, a.AddServer(s))
+	addr := a.Addr(s)
+	require.NotNil(t, addr)
+	assert.Len(t, a.Addrs(), 2)
+	assert.Len(t, a.Registry().activeListeners(), 2)
+	client := http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	r, err := client.Get("http://" + addr.String())
+	require.NoError(t, err)
+	r.Body.Close()
+
+	require.NoError(t, a.RemoveServer(s))
+	assert.Error(t, a.RemoveServer(s))
+	assert.Nil(t, a.Addr(s))
+	assert.Len(t, a.Addrs(), 1)
+	assert.Len(t, a.Registry().activeListeners(), 1)
+	_, err = net.Dial("tcp", addr.String())
+	assert.Error(t, err)
+
+	a.Shutdown()
+	assert.NoError(t, <-done)
+}
+
+func TestShutdownWithAcceptedConnection(t *testing.T) {
+	s := &http.Server{Addr: "127.0.0.1:0", Handler: http.HandlerFunc(root)}
+	a := NewApp(s)
+	done := serveApp(t, a)
+
+	// A connection is accepted, but the request is not sent yet.
+	c, err := net.Dial("tcp", a.Addr(s).String())
+	require.NoError(t, err)
+	defer c.Close()
+	a.mutex.Lock()
+	as := a.servers[0]
+	a.mutex.Unlock()
+	for i := 0; !as.conns.hasNew(); i++ {
+		require.True(t, i < 500, "connection is not accepted")
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// The request sent during shutdown is served.
+	go a.Shutdown()
+	time.Sleep(time.Millisecond * 100)
+	_, err = io.WriteString(c, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	r, err := http.ReadResponse(bufio.NewReader(c), nil)
+	require.NoError(t, err)
+	r.Body.Close()
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+
+	assert.NoError(t, <-done)
+}
+
+func TestAppRegistry(t *testing.T) {
+	s := &http.Server{Addr: "127.0.0.1:0", Handler: http.HandlerFunc(root)}
+	a := NewApp(s)
+	require.NoError(t, a.SetListenerKey(s, "api"))
+	assert.Nil(t, a.Registry())
+
+	// A listener registered in PreServeFn is exported with the servers.
+	extra := newTCPListener(t)
+	defer extra.Close()
+	a.PreServeFn = func(inherited bool) error {
+		return a.Registry().Register("extra", extra)
+	}
+	done := serveApp(t, a)
+
+	e := a.Registry()
+	require.NotNil(t, e)
+	files, env := e.Export()
+	require.Len(t, files, 2)
+	assert.NotEmpty(t, stringInSlice(env, "LISTEN_FDS=2"))
+	assert.NotEmpty(t, stringInSlice(env, "LISTEN_FDNAMES=api:extra"))
+
+	a.Shutdown()
+	assert.NoError(t, <-done)
+}
+
+func TestRemoveServerBeforeServing(t *testing.T) {
+	s := &http.Server{Addr: "127.0.0.1:0"}
+	a := NewApp(&http.Server{Addr: "127.0.0.1:0"}, s)
+	require.NoError(t, a.SetListenerKey(s, "removed"))
+	var addr net.Addr
+	a.PreServeFn = func(inherited bool) error {
+		addr = a.Addr(s)
+		return a.RemoveServer(s)
+	}
+	done := serveApp(t, a)
+
+	// The listener is neither passed to a child nor left open.
+	require.NotNil(t, addr)
+	assert.Len(t, a.Registry().activeListeners(), 1)
+	assert.False(t, a.Registry().expected["removed"])
+	_, err := net.Dial("tcp", addr.String())
+	assert.Error(t, err)
+
+	a.Shutdown()
+	assert.NoError(t, <-done)
+}
+
 func underlyingError(err error) error {
 	switch err := err.(type) {
 	case *os.PathError:
@@ -323,6 +791,11 @@ func root(w http.ResponseWriter, r *http.Request) {
 	logger.Printf("Handled root %d", os.Getpid())
 }
 
+func generation(w http.ResponseWriter, r *http.Request) {
+	info, _ := GenerationFromContext(r.Context())
+	json.NewEncoder(w).Encode(info)
+}
+
 func sleep(w http.ResponseWriter, r *http.Request) {
 	logger.Printf("Ready to handle message %s", r.RequestURI)
 
@@ -341,8 +814,26 @@ func startHTTPServer() {
 
 	var port string
 	var waitForParent bool
+	var maxDraining int
+	var pidFile string
+	var controlSocket string
+	var supervisor bool
+	var prefork int
+	var rendezvousSocket string
+	var strictListenPID bool
+	var execHelper bool
+	var ephemeral bool
 	flag.StringVar(&port, "port", "2607", "a port to bind to")
 	flag.BoolVar(&waitForParent, "waitForParent", false, "wait for parent before start serving (statefull)")
+	flag.IntVar(&maxDraining, "maxDraining", 0, "the maximum number of draining generations")
+	flag.StringVar(&pidFile, "pidFile", "", "a path to a pid file")
+	flag.StringVar(&controlSocket, "controlSocket", "", "a path to a control socket")
+	flag.BoolVar(&supervisor, "supervisor", false, "run workers under a supervisor")
+	flag.IntVar(&prefork, "prefork", 0, "the number of workers run under a supervisor")
+	flag.StringVar(&rendezvousSocket, "rendezvousSocket", "", "a path to a rendezvous socket")
+	flag.BoolVar(&strictListenPID, "strictListenPID", false, "reject LISTEN_PID=0")
+	flag.BoolVar(&execHelper, "execHelper", false, "start children via the exec helper")
+	flag.BoolVar(&ephemeral, "ephemeral", false, "add a server with an ephemeral port")
 	flag.Parse()
 
 	logger.Printf("Server started on port=%s with waitForParent=%v\n", port, waitForParent)
@@ -350,6 +841,26 @@ func startHTTPServer() {
 	r := mux.NewRouter()
 	r.Path("/").Methods("GET").HandlerFunc(root)
 	r.Path("/sleep").Methods("GET").HandlerFunc(sleep)
+	r.Path("/generation").Methods("GET").HandlerFunc(generation)
+	// The app unsets LISTEN_PID when it inherits listeners.
+	listenPID := os.Getenv(envListenPID)
+	r.Path("/listenpid").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, listenPID)
+	})
+	var a *App
+	r.Path("/addrs").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addrs := []string{}
+		for _, addr := range a.Addrs() {
+			addrs = append(addrs, addr.String())
+		}
+		json.NewEncoder(w).Encode(addrs)
+	})
+	r.Path("/restart").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := a.RestartWithReason(r.FormValue("reason"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
 
 	// Force timeout. 10 seconds is enough.
 	go func() {
@@ -361,10 +872,23 @@ func startHTTPServer() {
 		}
 	}()
 
-	a := NewApp(&http.Server{Addr: ":" + port, Handler: r})
+	a = NewApp(&http.Server{Addr: ":" + port, Handler: r})
+	if ephemeral {
+		a.AddServer(&http.Server{Addr: "127.0.0.1:0", Handler: r})
+	}
 	if waitForParent {
 		a.SetWaitParentShutdownTimeout(time.Second * 360)
 	}
+	a.SetMaxDrainingGenerations(maxDraining, EscalationPolicy{})
+	a.SetPIDFile(pidFile)
+	a.SetControlSocket(controlSocket)
+	a.SetRendezvousSocket(rendezvousSocket)
+	a.SetSupervisor(supervisor)
+	a.SetStrictListenPID(strictListenPID)
+	a.SetExecHelper(execHelper)
+	if prefork > 0 {
+		a.SetPrefork(prefork)
+	}
 	a.ListenAndServe()
 
 	logger.Printf("Server finished")
@@ -7,6 +7,8 @@ package zerodt
 
 import (
 	"context"
+	"errors"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -20,16 +22,24 @@ type App struct {
 	PreShutdownFn      func()
 	CompleteShutdownFn func()
 	PreParentExitFn    func()
+	WorkerCrashFn      func(pid int, err error)
+	DrainReportFn      func(r DrainReport)
+	ReopenLogsFn       func() error
 	servers            []*http.Server
+	state              State
+	mutex              sync.Mutex
 }
 
 // NewApp returns a new instance of App.
 func NewApp(servers ...*http.Server) *App {
-	return &App{nil, nil, nil, servers}
+	return &App{servers: servers}
 }
 
 // ListenAndServe calls ListenAndServe for all servers and returns first error if happens or nil.
 func (a *App) ListenAndServe() error {
+	a.setState(StateServing)
+	defer a.setState(StateStopped)
+
 	var sigWG sync.WaitGroup
 	sigWG.Add(1)
 	sigCtx, sigCancelFunc := context.WithCancel(context.Background())
@@ -59,6 +69,7 @@ func (a *App) ListenAndServe() error {
 
 // Shutdown calls Shutdown for all server and returns first error if happens or nil.
 func (a *App) Shutdown() {
+	a.setState(StateDraining)
 	errs := make(chan error)
 	for _, server := range a.servers {
 		server := server
@@ -78,10 +89,182 @@ func (a *App) Shutdown() {
 	}
 }
 
+// AddServer is not supported.
+func (a *App) AddServer(s *http.Server) error {
+	return errors.New("AddServer is not supported")
+}
+
+// RemoveServer is not supported.
+func (a *App) RemoveServer(s *http.Server) error {
+	return errors.New("RemoveServer is not supported")
+}
+
+// Addr always returns nil.
+func (a *App) Addr(s *http.Server) net.Addr {
+	return nil
+}
+
+// Addrs always returns nil.
+func (a *App) Addrs() []net.Addr {
+	return nil
+}
+
+// SetListenerKey does nothing.
+func (a *App) SetListenerKey(s *http.Server, key string) error {
+	return nil
+}
+
+// Restart is not supported.
+func (a *App) Restart() error {
+	return errors.New("Restart is not supported")
+}
+
+// RestartWithOptions is not supported.
+func (a *App) RestartWithOptions(opts RestartOptions) error {
+	return errors.New("Restart is not supported")
+}
+
+// RestartWithReason is not supported.
+func (a *App) RestartWithReason(reason string) error {
+	return errors.New("Restart is not supported")
+}
+
+// Generation returns the first generation.
+func (a *App) Generation() GenerationInfo {
+	return GenerationInfo{Generation: 1}
+}
+
+// SetRestartPolicy does nothing.
+func (a *App) SetRestartPolicy(p RestartPolicy) {
+}
+
+// SetMinRestartInterval does nothing.
+func (a *App) SetMinRestartInterval(d time.Duration) {
+}
+
+// SetMaxDrainingGenerations does nothing.
+func (a *App) SetMaxDrainingGenerations(n int, p EscalationPolicy) {
+}
+
+// DrainingPIDs always returns nil.
+func (a *App) DrainingPIDs() []int {
+	return nil
+}
+
+// SetPIDFile does nothing.
+func (a *App) SetPIDFile(path string) {
+}
+
+// SetStatusFile does nothing.
+func (a *App) SetStatusFile(path string) {
+}
+
+// SetSupervisor does nothing.
+func (a *App) SetSupervisor(enabled bool) {
+}
+
+// SetPrefork does nothing.
+func (a *App) SetPrefork(n int) {
+}
+
+// SetCrashRestartPolicy does nothing.
+func (a *App) SetCrashRestartPolicy(p CrashRestartPolicy) {
+}
+
+// SetControlSocket does nothing.
+func (a *App) SetControlSocket(path string) {
+}
+
+// SetRendezvousSocket does nothing.
+func (a *App) SetRendezvousSocket(path string) {
+}
+
+// SetSystemdFDStore does nothing.
+func (a *App) SetSystemdFDStore(enabled bool) {
+}
+
+// Status returns the current status of the app.
+func (a *App) Status() Status {
+	return Status{PID: os.Getpid(), Generation: 1, State: a.State()}
+}
+
+// State returns the current state of the app.
+func (a *App) State() State {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return a.state
+}
+
+func (a *App) setState(s State) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.state = s
+}
+
 // SetWaitParentShutdownTimeout does nothing.
 func (a *App) SetWaitParentShutdownTimeout(d time.Duration) {
 }
 
+// SetHeartbeatInterval does nothing.
+func (a *App) SetHeartbeatInterval(d time.Duration) {
+}
+
+// SetDrainReportInterval does nothing.
+func (a *App) SetDrainReportInterval(d time.Duration) {
+}
+
+// SetExecHelper does nothing.
+func (a *App) SetExecHelper(enabled bool) {
+}
+
+// SetStrictListenPID does nothing.
+func (a *App) SetStrictListenPID(strict bool) {
+}
+
+// Registry is not supported on windows.
+type Registry struct{}
+
+// NewRegistry is not supported.
+func NewRegistry() (*Registry, error) {
+	return nil, errors.New("NewRegistry is not supported")
+}
+
+// Registry returns nil.
+func (a *App) Registry() *Registry {
+	return nil
+}
+
+// Inherited returns nothing.
+func (r *Registry) Inherited() []ListenerStatus {
+	return []ListenerStatus{}
+}
+
+// Export returns nothing.
+func (r *Registry) Export() ([]*os.File, []string) {
+	return nil, nil
+}
+
+// Acquire is not supported.
+func (r *Registry) Acquire(key string, addr *net.TCPAddr) (*net.TCPListener, error) {
+	return nil, errors.New("Acquire is not supported")
+}
+
+// Register is not supported.
+func (r *Registry) Register(key string, l *net.TCPListener) error {
+	return errors.New("Register is not supported")
+}
+
+// Release does nothing.
+func (r *Registry) Release(l *net.TCPListener) {
+}
+
+// Listen is not supported.
+func (r *Registry) Listen(key, netStr, addrStr string) (*net.TCPListener, error) {
+	return nil, errors.New("Listen is not supported")
+}
+
 // SetWaitChildTimeout does nothing.
 func (a *App) SetWaitChildTimeout(d time.Duration) {
 }
@@ -0,0 +1,361 @@
+// Copyright 2017 Grigory Zubankov. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+//
+// +build linux darwin
+
+// Command zerodt controls a running app that uses zerodt. It restarts
+// the app and waits until the new generation is serving or the restart
+// fails, stops the app gracefully and prints the status of the app.
+//
+// An app is targeted by a pid file and signals or by a control socket
+// (see App.SetControlSocket). The control socket also allows to restart
+// the app with another binary, to reopen logs and to dump connections.
+//
+// The exit code is not 0 if a command fails. It allows to use zerodt
+// in a systemd unit:
+//
+//	ExecReload=/usr/bin/zerodt -pidfile /run/app.pid -status /run/app.json restart
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ssgreg/zerodt"
+)
+
+const usage = `Usage: zerodt [flags] command [args]
+
+Commands:
+  restart [path [args]]  restart the app and wait until the new generation is serving,
+                         path and args of a new binary require -socket
+  stop                   stop the app gracefully and wait until it exits
+  status                 print the status of the app
+  reopen-logs            ask the app to reopen logs, requires -socket
+  connections            print open connections, requires -socket
+
+Flags:
+`
+
+var (
+	pidFile    = flag.String("pidfile", "", "a path to the app's pid file (see App.SetPIDFile)")
+	statusFile = flag.String("status", "", "a path to the app's status file (see App.SetStatusFile)")
+	socket     = flag.String("socket", "", "a path to the app's control socket (see App.SetControlSocket)")
+	timeout    = flag.Duration("timeout", time.Minute*2, "the maximum amount of time to wait for a command to complete")
+)
+
+// pollInterval is a time between two checks of the app's state.
+const pollInterval = time.Millisecond * 100
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 || *pidFile == "" && *socket == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch {
+	case *socket != "":
+		err = control(flag.Arg(0), flag.Args()[1:])
+	case flag.NArg() != 1:
+		flag.Usage()
+		os.Exit(2)
+	case flag.Arg(0) == "restart":
+		err = restart()
+	case flag.Arg(0) == "stop":
+		err = stop()
+	case flag.Arg(0) == "status":
+		err = status()
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "zerodt: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// control sends a command to the control socket and prints a reply.
+func control(command string, args []string) error {
+	req := zerodt.ControlRequest{}
+	switch command {
+	case "restart":
+		req.Command = zerodt.ControlRestart
+		if len(args) > 0 {
+			req.Restart = zerodt.RestartOptions{Path: args[0], Args: args[1:]}
+		}
+	case "stop":
+		req.Command = zerodt.ControlShutdown
+	case "status":
+		req.Command = zerodt.ControlStatus
+	case "reopen-logs":
+		req.Command = zerodt.ControlReopenLogs
+	case "connections":
+		req.Command = zerodt.ControlDumpConnections
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if req.Command != zerodt.ControlRestart && len(args) > 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	reply, err := zerodt.SendControlCommand(*socket, req, *timeout)
+	if err != nil {
+		return err
+	}
+	if reply.Error != "" {
+		return errors.New(reply.Error)
+	}
+	switch req.Command {
+	case zerodt.ControlRestart:
+		if reply.Status == nil || reply.Status.LastRestart == nil {
+			return errors.New("no restart result in the reply")
+		}
+		fmt.Printf("restarted: pid=%d, generation=%d\n", reply.Status.LastRestart.ChildPID, reply.Status.LastRestart.Generation)
+	case zerodt.ControlShutdown:
+		if reply.Status == nil {
+			return errors.New("no status in the reply")
+		}
+		return waitExit(reply.Status.PID)
+	case zerodt.ControlStatus:
+		return printJSON(reply.Status)
+	case zerodt.ControlDumpConnections:
+		return printJSON(reply.Connections)
+	default:
+		fmt.Println("ok")
+	}
+	return nil
+}
+
+// restart sends SIGUSR2 to the app and waits for the result. A restart
+// succeeded when a new generation is serving: it owns the pid file (and
+// the status file if it's set). It failed when the app reports an error
+// in the status file, a successor exits before it's serving or the app
+// exits without a successor.
+//
+// A supervisor keeps its pid and replaces its workers. Its restart
+// succeeded when the status file reports a successful restart or, if
+// there is no status file, when all the old workers have exited. An old
+// worker is shut down once its successor has accepted the listeners.
+func restart() error {
+	pid, err := readPID()
+	if err != nil {
+		return err
+	}
+	// Children that exist before the signal are not successors.
+	before := children(pid)
+	successors := make(map[int]bool)
+	started := time.Now()
+	err = syscall.Kill(pid, syscall.SIGUSR2)
+	if err != nil {
+		return fmt.Errorf("failed to signal pid=%d: %v", pid, err)
+	}
+
+	return poll(func() (bool, error) {
+		if *statusFile != "" {
+			st, err := readStatus()
+			if err == nil {
+				if st.PID != pid && st.State == zerodt.StateServing {
+					fmt.Printf("restarted: pid=%d -> pid=%d, generation=%d\n", pid, st.PID, st.Generation)
+					return true, nil
+				}
+				r := st.LastRestart
+				if st.PID == pid && r != nil && r.Error != "" && !r.Time.Before(started) {
+					return true, errors.New(r.Error)
+				}
+				// A supervisor has replaced its workers.
+				if st.PID == pid && r != nil && !r.Time.Before(started) && len(st.Workers) > 0 && st.State == zerodt.StateServing {
+					fmt.Printf("restarted: pid=%d, generation=%d\n", pid, r.Generation)
+					return true, nil
+				}
+			}
+		} else {
+			// A child writes the pid file when it starts serving.
+			newPID, err := readPID()
+			if err == nil && newPID != pid && alive(newPID) {
+				fmt.Printf("restarted: pid=%d -> pid=%d\n", pid, newPID)
+				return true, nil
+			}
+		}
+
+		// A successor that exits while the old pid is still the owner
+		// means the restart failed. There is no need to wait for the
+		// timeout.
+		running := false
+		if all, err := processes(); err == nil {
+			for cpid, p := range all {
+				if p.ppid == pid && !before[cpid] {
+					successors[cpid] = true
+				}
+			}
+			var workers []int
+			for cpid := range successors {
+				if p, ok := all[cpid]; ok && !p.zombie {
+					running = true
+					workers = append(workers, cpid)
+					continue
+				}
+				if newPID, err := readPID(); err == nil && newPID == pid {
+					return true, fmt.Errorf("successor pid=%d of pid=%d exited before serving", cpid, pid)
+				}
+			}
+			// The old workers of a supervisor have been replaced.
+			if *statusFile == "" && len(before) > 0 && len(workers) >= len(before) && !anyRunning(all, before) {
+				sort.Ints(workers)
+				fmt.Printf("restarted: pid=%d, workers=%v\n", pid, workers)
+				return true, nil
+			}
+		}
+
+		if !alive(pid) && !running {
+			if newPID, err := readPID(); err != nil || newPID == pid {
+				return true, fmt.Errorf("pid=%d exited without a successor", pid)
+			}
+		}
+		return false, nil
+	})
+}
+
+// stop sends SIGTERM to the app and waits for it to exit.
+func stop() error {
+	pid, err := readPID()
+	if err != nil {
+		return err
+	}
+	err = syscall.Kill(pid, syscall.SIGTERM)
+	if err != nil {
+		return fmt.Errorf("failed to signal pid=%d: %v", pid, err)
+	}
+	return waitExit(pid)
+}
+
+// waitExit waits for a process to exit.
+func waitExit(pid int) error {
+	return poll(func() (bool, error) {
+		if alive(pid) {
+			return false, nil
+		}
+		fmt.Printf("stopped: pid=%d\n", pid)
+		return true, nil
+	})
+}
+
+// status prints the status file or just a pid if there is no status
+// file.
+func status() error {
+	pid, err := readPID()
+	if err != nil {
+		return err
+	}
+	if !alive(pid) {
+		return fmt.Errorf("pid=%d is not running", pid)
+	}
+	if *statusFile == "" {
+		fmt.Printf("running: pid=%d\n", pid)
+		return nil
+	}
+	st, err := readStatus()
+	if err != nil {
+		return err
+	}
+	return printJSON(st)
+}
+
+func printJSON(v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
+
+// poll calls fn until it's done or the timeout ends.
+func poll(fn func() (bool, error)) error {
+	deadline := time.Now().Add(*timeout)
+	for time.Now().Before(deadline) {
+		done, err := fn()
+		if done {
+			return err
+		}
+		time.Sleep(pollInterval)
+	}
+	return fmt.Errorf("timeout %v exceeded", *timeout)
+}
+
+func readPID() (int, error) {
+	b, err := ioutil.ReadFile(*pidFile)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, fmt.Errorf("bad pid file %s: %v", *pidFile, err)
+	}
+	return pid, nil
+}
+
+func readStatus() (zerodt.Status, error) {
+	st := zerodt.Status{}
+	b, err := ioutil.ReadFile(*statusFile)
+	if err != nil {
+		return st, err
+	}
+	err = json.Unmarshal(b, &st)
+	return st, err
+}
+
+// process describes a process of the system.
+type process struct {
+	ppid   int
+	zombie bool
+}
+
+// children returns a set of children of a process. It's empty if the
+// processes can't be listed.
+func children(pid int) map[int]bool {
+	result := make(map[int]bool)
+	all, err := processes()
+	if err != nil {
+		return result
+	}
+	for cpid, p := range all {
+		if p.ppid == pid {
+			result[cpid] = true
+		}
+	}
+	return result
+}
+
+// anyRunning checks whether any of the given processes is running.
+func anyRunning(all map[int]process, pids map[int]bool) bool {
+	for pid := range pids {
+		if p, ok := all[pid]; ok && !p.zombie {
+			return true
+		}
+	}
+	return false
+}
+
+func alive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
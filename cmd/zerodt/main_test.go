@@ -0,0 +1,175 @@
+// Copyright 2017 Grigory Zubankov. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+//
+// +build linux darwin
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ssgreg/zerodt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	// The test binary runs an app with the given pid file.
+	envTestApp = "ZERODT_TEST_APP"
+	// A child of the app exits before it accepts the listeners.
+	envTestFailChild = "ZERODT_TEST_FAIL_CHILD"
+	// The app runs a worker under a supervisor and writes a status
+	// file next to the pid file.
+	envTestSupervisor = "ZERODT_TEST_SUPERVISOR"
+)
+
+func TestMain(m *testing.M) {
+	if path := os.Getenv(envTestApp); path != "" {
+		runTestApp(path)
+		return
+	}
+	os.Exit(m.Run())
+}
+
+func runTestApp(path string) {
+	if os.Getenv(envTestFailChild) != "" && os.Getenv("LISTEN_FDS") != "" {
+		os.Exit(1)
+	}
+	a := zerodt.NewApp(&http.Server{Addr: "127.0.0.1:0", Handler: http.NotFoundHandler()})
+	a.SetPIDFile(path)
+	if os.Getenv(envTestSupervisor) != "" {
+		a.SetSupervisor(true)
+		a.SetStatusFile(testStatusFile(path))
+	}
+	err := a.ListenAndServe()
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+// testStatusFile returns a path to the status file of a supervisor.
+func testStatusFile(pidFile string) string {
+	return filepath.Join(filepath.Dir(pidFile), "app.json")
+}
+
+// startTestApp starts an app and waits until it owns the pid file.
+func startTestApp(t *testing.T, env ...string) *exec.Cmd {
+	dir, err := ioutil.TempDir("", "zerodt-cmd-")
+	require.NoError(t, err)
+	*pidFile = filepath.Join(dir, "app.pid")
+	*statusFile = ""
+	*timeout = time.Second * 30
+
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(), append(env, envTestApp+"="+*pidFile)...)
+	require.NoError(t, cmd.Start())
+	require.NoError(t, poll(func() (bool, error) {
+		pid, err := readPID()
+		return err == nil && pid == cmd.Process.Pid, nil
+	}))
+	return cmd
+}
+
+// stopTestApp stops the app that owns the pid file and waits until
+// the file is removed.
+func stopTestApp(t *testing.T, cmd *exec.Cmd) {
+	defer os.RemoveAll(filepath.Dir(*pidFile))
+
+	pid, err := readPID()
+	require.NoError(t, err)
+	require.NoError(t, syscall.Kill(pid, syscall.SIGTERM))
+	assert.NoError(t, poll(func() (bool, error) {
+		_, err := os.Stat(*pidFile)
+		return os.IsNotExist(err), nil
+	}))
+	cmd.Wait()
+}
+
+func TestRestartPIDFile(t *testing.T) {
+	cmd := startTestApp(t)
+	defer stopTestApp(t, cmd)
+
+	require.NoError(t, restart())
+	pid, err := readPID()
+	require.NoError(t, err)
+	assert.NotEqual(t, cmd.Process.Pid, pid)
+	assert.True(t, alive(pid))
+
+	// The old generation exits after the restart.
+	assert.NoError(t, cmd.Wait())
+}
+
+func TestRestartPIDFileChildFails(t *testing.T) {
+	cmd := startTestApp(t, envTestFailChild+"=1")
+	defer stopTestApp(t, cmd)
+
+	started := time.Now()
+	err := restart()
+	require.Error(t, err)
+	assert.Regexp(t, "^successor pid=[0-9]+ of pid=[0-9]+ exited before serving$", err.Error())
+	assert.True(t, time.Since(started) < *timeout/2)
+
+	// The old generation is still the owner.
+	pid, err := readPID()
+	require.NoError(t, err)
+	assert.Equal(t, cmd.Process.Pid, pid)
+	assert.True(t, alive(pid))
+}
+
+// startTestSupervisor starts an app under a supervisor and waits until
+// its worker is serving.
+func startTestSupervisor(t *testing.T) *exec.Cmd {
+	cmd := startTestApp(t, envTestSupervisor+"=1")
+	require.NoError(t, poll(func() (bool, error) {
+		b, err := ioutil.ReadFile(testStatusFile(*pidFile))
+		if err != nil {
+			return false, nil
+		}
+		st := zerodt.Status{}
+		err = json.Unmarshal(b, &st)
+		return err == nil && st.State == zerodt.StateServing && len(st.Workers) == 1, nil
+	}))
+	return cmd
+}
+
+func TestRestartSupervisorStatus(t *testing.T) {
+	cmd := startTestSupervisor(t)
+	defer stopTestApp(t, cmd)
+	*statusFile = testStatusFile(*pidFile)
+	before := children(cmd.Process.Pid)
+
+	// The supervisor keeps its pid and replaces the worker.
+	require.NoError(t, restart())
+	st, err := readStatus()
+	require.NoError(t, err)
+	assert.Equal(t, cmd.Process.Pid, st.PID)
+	assert.Equal(t, 2, st.Generation)
+	require.Len(t, st.Workers, 1)
+	assert.False(t, before[st.Workers[0].PID])
+}
+
+func TestRestartSupervisorWorkers(t *testing.T) {
+	cmd := startTestSupervisor(t)
+	defer stopTestApp(t, cmd)
+	before := children(cmd.Process.Pid)
+	require.Len(t, before, 1)
+
+	// Without a status file the restart is complete when the old
+	// worker has exited.
+	require.NoError(t, restart())
+	pid, err := readPID()
+	require.NoError(t, err)
+	assert.Equal(t, cmd.Process.Pid, pid)
+	all, err := processes()
+	require.NoError(t, err)
+	assert.False(t, anyRunning(all, before))
+}
@@ -0,0 +1,38 @@
+// Copyright 2017 Grigory Zubankov. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+//
+// +build darwin
+
+package main
+
+import (
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// processes returns all processes of the system by their pids.
+func processes() (map[int]process, error) {
+	out, err := exec.Command("ps", "-A", "-o", "pid=,ppid=,stat=").Output()
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[int]process)
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		pid, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		ppid, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+		result[pid] = process{ppid: ppid, zombie: strings.HasPrefix(fields[2], "Z")}
+	}
+	return result, nil
+}
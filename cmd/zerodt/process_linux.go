@@ -0,0 +1,50 @@
+// Copyright 2017 Grigory Zubankov. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+//
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// processes returns all processes of the system by their pids.
+func processes() (map[int]process, error) {
+	names, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[int]process)
+	for _, fi := range names {
+		pid, err := strconv.Atoi(fi.Name())
+		if err != nil {
+			continue
+		}
+		// A process may exit at any moment.
+		b, err := ioutil.ReadFile("/proc/" + fi.Name() + "/stat")
+		if err != nil {
+			continue
+		}
+		// A command name may contain spaces and parentheses. The rest
+		// of fields follow the last parenthesis: a state and a ppid.
+		i := bytes.LastIndexByte(b, ')')
+		if i == -1 {
+			continue
+		}
+		fields := strings.Fields(string(b[i+1:]))
+		if len(fields) < 2 {
+			continue
+		}
+		ppid, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+		result[pid] = process{ppid: ppid, zombie: fields[0] == "Z"}
+	}
+	return result, nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2017 Grigory Zubankov. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+//
+
+package zerodt
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+)
+
+// Codec encodes and decodes messages of a StreamMessenger. Its ID is
+// recorded in the header of every message, so a receiver detects a
+// message encoded by another codec.
+type Codec interface {
+	// ID identifies a codec. IDs of all codecs used together must be
+	// different.
+	ID() byte
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	// JSONCodec uses encoding/json. It is compatible with messengers
+	// that have no codecs.
+	JSONCodec Codec = jsonCodec{}
+	// GobCodec uses encoding/gob. It keeps types of values, e.g.
+	// durations and byte slices, and is faster for big messages.
+	GobCodec Codec = gobCodec{}
+	// RawCodec sends byte slices as is. It marshals []byte and
+	// unmarshals to *[]byte.
+	RawCodec Codec = rawCodec{}
+)
+
+type jsonCodec struct{}
+
+// ID returns the last byte of the prefix of a message without a codec.
+func (jsonCodec) ID() byte {
+	return 'O'
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) ID() byte {
+	return 'G'
+}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	err := gob.NewEncoder(&b).Encode(v)
+	return b.Bytes(), err
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type rawCodec struct{}
+
+func (rawCodec) ID() byte {
+	return 'R'
+}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	switch b := v.(type) {
+	case []byte:
+		return b, nil
+	case *[]byte:
+		return *b, nil
+	}
+	return nil, fmt.Errorf("RawCodec: can't marshal %T", v)
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("RawCodec: can't unmarshal to %T", v)
+	}
+	*b = append((*b)[:0], data...)
+	return nil
+}
@@ -0,0 +1,120 @@
+// Copyright 2017 Grigory Zubankov. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+//
+// +build linux darwin
+
+package zerodt
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// How long a closing server waits for accepted connections to
+	// read their requests.
+	newConnTimeout = time.Millisecond * 500
+	// How often the state of accepted connections is checked.
+	newConnPollInterval = time.Millisecond * 10
+)
+
+// connTracker keeps the state of open connections of a server.
+type connTracker struct {
+	mutex sync.Mutex
+	conns map[net.Conn]connState
+}
+
+type connState struct {
+	state http.ConnState
+	since time.Time
+}
+
+// track returns a http.Server.ConnState hook that records connection
+// state changes and calls the next hook if any.
+func (t *connTracker) track(next func(net.Conn, http.ConnState)) func(net.Conn, http.ConnState) {
+	return func(c net.Conn, s http.ConnState) {
+		t.mutex.Lock()
+		if t.conns == nil {
+			t.conns = make(map[net.Conn]connState)
+		}
+		switch s {
+		case http.StateHijacked, http.StateClosed:
+			delete(t.conns, c)
+		default:
+			t.conns[c] = connState{s, time.Now()}
+		}
+		t.mutex.Unlock()
+
+		if next != nil {
+			next(c, s)
+		}
+	}
+}
+
+// waitNew waits until all accepted connections have read a request or
+// have been closed, but no longer than the timeout.
+func (t *connTracker) waitNew(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) && t.hasNew() {
+		time.Sleep(newConnPollInterval)
+	}
+}
+
+// hasNew checks whether there are connections in http.StateNew.
+func (t *connTracker) hasNew() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, cs := range t.conns {
+		if cs.state == http.StateNew {
+			return true
+		}
+	}
+	return false
+}
+
+// report returns the drain progress of a server. A connection becomes
+// active when it starts to handle a request, so the age of a request
+// is the time since the last state change.
+func (t *connTracker) report(key string, now time.Time) ServerDrainReport {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	r := ServerDrainReport{Listener: key}
+	r.OpenConnections = len(t.conns)
+	for _, cs := range t.conns {
+		if cs.state != http.StateActive {
+			continue
+		}
+		r.InFlightRequests++
+		if age := now.Sub(cs.since); age > r.OldestRequestAge {
+			r.OldestRequestAge = age
+		}
+	}
+	return r
+}
+
+// connections returns open connections sorted by the time of the last
+// state change.
+func (t *connTracker) connections(key string) []ConnectionInfo {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	result := make([]ConnectionInfo, 0, len(t.conns))
+	for c, cs := range t.conns {
+		result = append(result, ConnectionInfo{
+			Listener:   key,
+			RemoteAddr: c.RemoteAddr().String(),
+			State:      cs.state.String(),
+			Since:      cs.since,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Since.Before(result[j].Since)
+	})
+	return result
+}
@@ -0,0 +1,276 @@
+// Copyright 2017 Grigory Zubankov. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+//
+// +build linux darwin
+
+package zerodt
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Control commands.
+const (
+	// ControlRestart restarts the app. The reply is sent when the
+	// child has accepted the listeners. It carries the status of the
+	// parent that is draining since then.
+	ControlRestart = "restart"
+	// ControlStatus returns the status of the app.
+	ControlStatus = "status"
+	// ControlShutdown starts a graceful shutdown. The reply does not
+	// wait for the drain, it carries the status with a pid to wait for.
+	ControlShutdown = "shutdown"
+	// ControlReopenLogs calls ReopenLogsFn.
+	ControlReopenLogs = "reopen-logs"
+	// ControlDumpConnections returns open connections of all servers.
+	ControlDumpConnections = "dump-connections"
+)
+
+const (
+	// Const timeout to receive a control request and to send a reply.
+	controlTimeout = time.Second * 5
+)
+
+// ControlRequest is a command sent to the control socket.
+type ControlRequest struct {
+	Command string
+	// Restart describes a process to start for ControlRestart.
+	Restart RestartOptions
+}
+
+// ControlReply is a reply to a control command.
+type ControlReply struct {
+	// Error is empty if a command succeeded.
+	Error string
+	// Status is set for ControlStatus, ControlRestart and
+	// ControlShutdown.
+	Status *Status
+	// Connections is set for ControlDumpConnections.
+	Connections []ConnectionInfo
+}
+
+// ConnectionInfo describes an open connection of a server.
+type ConnectionInfo struct {
+	// Listener is the key of server's listener.
+	Listener   string
+	RemoteAddr string
+	// State is one of http.ConnState values.
+	State string
+	// Since is the time of the last state change.
+	Since time.Time
+}
+
+// SetControlSocket sets a path to a unix socket that accepts control
+// commands. Each connection carries a single ControlRequest and a
+// single ControlReply using StreamMessenger framing. The socket is
+// never passed to a child, the child replaces it with its own one when
+// it accepts the listeners.
+//
+// The socket is accessible by the owner only. Processes of other users
+// except root are rejected.
+//
+// Default value is empty that means no control socket.
+func (a *App) SetControlSocket(path string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.controlPath = path
+}
+
+// SendControlCommand sends a command to the control socket of a
+// running app and waits for a reply.
+func SendControlCommand(path string, req ControlRequest, timeout time.Duration) (*ControlReply, error) {
+	c, err := net.DialTimeout("unix", path, timeout)
+	if err != nil {
+		return nil, err
+	}
+	m := NewStreamMessenger(c)
+	defer m.Close()
+
+	m.SetDeadline(time.Now().Add(timeout))
+	err = m.Send(req)
+	if err != nil {
+		return nil, err
+	}
+	reply := &ControlReply{}
+	err = m.Recv(reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// listenControlSocket starts listening on the control socket. It must
+// be called with mutex held.
+func (a *App) listenControlSocket() error {
+	if a.controlPath == "" || a.controlListener != nil {
+		return nil
+	}
+	// A child replaces its parent's socket, the first process checks
+	// there is no other instance.
+	if a.generation == 1 {
+		c, err := net.Dial("unix", a.controlPath)
+		if err == nil {
+			c.Close()
+			return fmt.Errorf("control socket %s is used by another instance", a.controlPath)
+		}
+	}
+	l, err := listenUnixSocket(a.controlPath)
+	if err != nil {
+		return err
+	}
+	a.controlListener = l
+	logger.Printf("listening control socket %s", a.controlPath)
+
+	go a.acceptControl(l)
+	return nil
+}
+
+// listenUnixSocket creates a socket with a temporary name and renames
+// it, so the path always points to a listening socket during a restart.
+// The socket file is not removed on close.
+func listenUnixSocket(path string) (*net.UnixListener, error) {
+	tmp := filepath.Join(filepath.Dir(path), fmt.Sprintf(".%s.%d.tmp", filepath.Base(path), os.Getpid()))
+	os.Remove(tmp)
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// The socket is removed by an owner only.
+	l.SetUnlinkOnClose(false)
+	// Other users can't connect. Peers connected before are rejected
+	// by checkPeer.
+	err = os.Chmod(tmp, 0600)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		l.Close()
+		os.Remove(tmp)
+		return nil, err
+	}
+	return l, nil
+}
+
+// closeControlSocket stops listening on the control socket. The socket
+// file is removed if the current process owns it. It must be called
+// with mutex held.
+func (a *App) closeControlSocket() {
+	if a.controlListener == nil {
+		return
+	}
+	a.controlListener.Close()
+	a.controlListener = nil
+	if a.owner {
+		os.Remove(a.controlPath)
+	}
+}
+
+// checkPeer checks that a connected process runs as the same user as
+// the current process or as root. It returns a pid of the process (see
+// peerCred).
+func checkPeer(c *net.UnixConn) (int, error) {
+	pid, uid, err := peerCred(c)
+	if err != nil {
+		return 0, err
+	}
+	if uid != os.Getuid() && uid != 0 {
+		return 0, fmt.Errorf("peer runs as uid %d, expected uid %d", uid, os.Getuid())
+	}
+	return pid, nil
+}
+
+func (a *App) acceptControl(l *net.UnixListener) {
+	for {
+		c, err := l.AcceptUnix()
+		if err != nil {
+			// Closed by closeControlSocket.
+			return
+		}
+		_, err = checkPeer(c)
+		if err != nil {
+			logger.Printf("control connection rejected: %v", err)
+			c.Close()
+			continue
+		}
+		a.controlWG.Add(1)
+		go func() {
+			defer a.controlWG.Done()
+			a.serveControl(NewStreamMessenger(c))
+		}()
+	}
+}
+
+// serveControl handles a single control command.
+func (a *App) serveControl(m *StreamMessenger) {
+	defer m.Close()
+
+	m.SetDeadline(time.Now().Add(controlTimeout))
+	req := ControlRequest{}
+	err := m.Recv(&req)
+	if err != nil {
+		logger.Printf("failed to receive control request with: %v", err)
+		return
+	}
+	logger.Printf("%q control command", req.Command)
+
+	reply, after := a.handleControl(req)
+	m.SetDeadline(time.Now().Add(controlTimeout))
+	err = m.Send(reply)
+	if err != nil {
+		logger.Printf("failed to send control reply with: %v", err)
+	}
+	if after != nil {
+		after()
+	}
+}
+
+// handleControl executes a control command and returns a reply and
+// an optional function to call after the reply is sent.
+func (a *App) handleControl(req ControlRequest) (*ControlReply, func()) {
+	reply := &ControlReply{}
+	switch req.Command {
+	case ControlRestart:
+		err := a.restart(req.Restart, TriggerControl)
+		if err != nil {
+			reply.Error = err.Error()
+		}
+		st := a.Status()
+		reply.Status = &st
+	case ControlStatus:
+		st := a.Status()
+		reply.Status = &st
+	case ControlShutdown:
+		st := a.Status()
+		reply.Status = &st
+		// Don't make a client to wait for the whole drain.
+		return reply, func() { go a.Shutdown() }
+	case ControlReopenLogs:
+		err := a.ReopenLogsFn()
+		if err != nil {
+			reply.Error = err.Error()
+		}
+	case ControlDumpConnections:
+		reply.Connections = a.connections()
+	default:
+		reply.Error = fmt.Sprintf("unknown command: %q", req.Command)
+	}
+	return reply, nil
+}
+
+// connections returns open connections of all servers.
+func (a *App) connections() []ConnectionInfo {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	result := []ConnectionInfo{}
+	for _, as := range a.servers {
+		result = append(result, as.conns.connections(as.key)...)
+	}
+	return result
+}
@@ -0,0 +1,142 @@
+// Copyright 2017 Grigory Zubankov. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+//
+// +build linux darwin
+
+package zerodt
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newControlApp(t *testing.T, path string) *App {
+	a := NewApp()
+	a.SetControlSocket(path)
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.owner = true
+	a.generation = 1
+	require.NoError(t, a.listenControlSocket())
+	return a
+}
+
+func TestControlSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zerodt-control-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.sock")
+
+	a := newControlApp(t, path)
+	reopened := false
+	a.ReopenLogsFn = func() error {
+		reopened = true
+		return errors.New("failed")
+	}
+
+	reply, err := SendControlCommand(path, ControlRequest{Command: ControlStatus}, time.Second)
+	require.NoError(t, err)
+	assert.Empty(t, reply.Error)
+	assert.Equal(t, os.Getpid(), reply.Status.PID)
+	assert.Equal(t, StateStarting, reply.Status.State)
+
+	reply, err = SendControlCommand(path, ControlRequest{Command: ControlRestart}, time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "restart rejected while starting: app is not serving", reply.Error)
+	assert.Equal(t, reply.Error, reply.Status.LastRestart.Error)
+
+	reply, err = SendControlCommand(path, ControlRequest{Command: ControlReopenLogs}, time.Second)
+	require.NoError(t, err)
+	assert.True(t, reopened)
+	assert.Equal(t, "failed", reply.Error)
+
+	reply, err = SendControlCommand(path, ControlRequest{Command: ControlDumpConnections}, time.Second)
+	require.NoError(t, err)
+	assert.Empty(t, reply.Error)
+	assert.Empty(t, reply.Connections)
+
+	reply, err = SendControlCommand(path, ControlRequest{Command: "unknown"}, time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, `unknown command: "unknown"`, reply.Error)
+
+	// Another instance can't use the same socket.
+	b := NewApp()
+	b.SetControlSocket(path)
+	b.generation = 1
+	assert.Error(t, b.listenControlSocket())
+
+	a.mutex.Lock()
+	a.closeControlSocket()
+	a.mutex.Unlock()
+	a.controlWG.Wait()
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestConnTracker(t *testing.T) {
+	var ct connTracker
+	var states []http.ConnState
+	fn := ct.track(func(c net.Conn, s http.ConnState) {
+		states = append(states, s)
+	})
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	fn(c1, http.StateNew)
+	fn(c2, http.StateNew)
+	fn(c1, http.StateActive)
+	conns := ct.connections("key")
+	require.Len(t, conns, 2)
+	assert.Equal(t, "key", conns[0].Listener)
+	assert.Equal(t, "new", conns[0].State)
+	assert.Equal(t, "active", conns[1].State)
+
+	fn(c1, http.StateClosed)
+	fn(c2, http.StateHijacked)
+	assert.Empty(t, ct.connections("key"))
+	assert.Equal(t, []http.ConnState{http.StateNew, http.StateNew, http.StateActive, http.StateClosed, http.StateHijacked}, states)
+}
+
+func TestDrainReport(t *testing.T) {
+	a := NewApp(&http.Server{Addr: ":1"}, &http.Server{Addr: ":2"})
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	fn := a.servers[0].conns.track(nil)
+	fn(c1, http.StateActive)
+	fn(c2, http.StateIdle)
+
+	reports := make(chan DrainReport, 1)
+	a.DrainReportFn = func(r DrainReport) {
+		select {
+		case reports <- r:
+		default:
+		}
+	}
+	a.SetDrainReportInterval(time.Millisecond * 50)
+	a.drainStart = time.Now()
+	stop := a.reportDrain()
+	r := <-reports
+	stop()
+
+	assert.Equal(t, os.Getpid(), r.PID)
+	assert.True(t, r.Elapsed > 0)
+	assert.Equal(t, 2, r.OpenConnections)
+	assert.Equal(t, 1, r.InFlightRequests)
+	assert.True(t, r.OldestRequestAge > 0)
+	require.Len(t, r.Servers, 2)
+	assert.Equal(t, 2, r.Servers[0].OpenConnections)
+	assert.Equal(t, 0, r.Servers[1].OpenConnections)
+}
@@ -0,0 +1,235 @@
+// Copyright 2017 Grigory Zubankov. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+//
+// +build linux darwin
+
+package zerodt
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// SetMaxDrainingGenerations sets the maximum number of previous
+// generations that may be draining at the same time. A child checks
+// the limit when it takes over and stops the oldest generations early
+// according to the escalation policy.
+//
+// Default value is 0 that means no limit.
+func (a *App) SetMaxDrainingGenerations(n int, p EscalationPolicy) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.maxDraining = n
+	a.escalationPolicy = p
+}
+
+// SetDrainReportInterval sets an interval of drain reports while the
+// app is shutting down. A report describes the remaining connections
+// and requests of each server. It is logged and passed to
+// DrainReportFn. A child receives reports of its parent with
+// heartbeats (see SetHeartbeatInterval) and passes them to its
+// DrainReportFn too.
+//
+// Default value is 5 seconds. 0 means no reports.
+func (a *App) SetDrainReportInterval(d time.Duration) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.drainReportInterval = d
+}
+
+// drainReport returns the drain progress of all servers.
+func (a *App) drainReport() DrainReport {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	now := time.Now()
+	r := DrainReport{PID: os.Getpid()}
+	if !a.drainStart.IsZero() {
+		r.Elapsed = now.Sub(a.drainStart)
+	}
+	for _, as := range a.servers {
+		sr := as.conns.report(as.key, now)
+		r.OpenConnections += sr.OpenConnections
+		r.InFlightRequests += sr.InFlightRequests
+		if sr.OldestRequestAge > r.OldestRequestAge {
+			r.OldestRequestAge = sr.OldestRequestAge
+		}
+		r.Servers = append(r.Servers, sr)
+	}
+	return r
+}
+
+// reportDrain reports the drain progress periodically until the
+// returned function is called.
+func (a *App) reportDrain() func() {
+	a.mutex.Lock()
+	interval := a.drainReportInterval
+	a.mutex.Unlock()
+	if interval <= 0 {
+		return func() {}
+	}
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+			}
+			r := a.drainReport()
+			logDrainReport(r)
+			a.DrainReportFn(r)
+		}
+	}()
+	return func() {
+		close(stop)
+		<-stopped
+	}
+}
+
+func logDrainReport(r DrainReport) {
+	logger.Printf("pid=%d is draining for %v: %d connections, %d requests in flight, the oldest for %v", r.PID, r.Elapsed, r.OpenConnections, r.InFlightRequests, r.OldestRequestAge)
+	for _, sr := range r.Servers {
+		logger.Printf("pid=%d is draining %s: %d connections, %d requests in flight, the oldest for %v", r.PID, sr.Listener, sr.OpenConnections, sr.InFlightRequests, sr.OldestRequestAge)
+	}
+}
+
+// drainingProcess identifies a draining generation. A pid may be reused
+// by another process after the generation exits, so the start time of
+// the process is compared as well.
+type drainingProcess struct {
+	pid   int
+	start int64
+}
+
+// alive checks whether the generation is still running.
+func (p drainingProcess) alive() bool {
+	start, err := processStartTime(p.pid)
+	return err == nil && start == p.start
+}
+
+// newDrainingProcess identifies a running process.
+func newDrainingProcess(pid int) (drainingProcess, error) {
+	start, err := processStartTime(pid)
+	return drainingProcess{pid, start}, err
+}
+
+// DrainingPIDs returns pids of the previous generations that are still
+// draining, the oldest first. Generations that have already finished
+// are forgotten.
+func (a *App) DrainingPIDs() []int {
+	a.mutex.Lock()
+	draining := make([]drainingProcess, len(a.draining))
+	copy(draining, a.draining)
+	a.mutex.Unlock()
+
+	pids := make([]int, 0, len(draining))
+	finished := make(map[drainingProcess]bool)
+	for _, p := range draining {
+		if p.alive() {
+			pids = append(pids, p.pid)
+		} else {
+			finished[p] = true
+		}
+	}
+	if len(finished) == 0 {
+		return pids
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	alive := a.draining[:0]
+	for _, p := range a.draining {
+		if !finished[p] {
+			alive = append(alive, p)
+		}
+	}
+	a.draining = alive
+	return pids
+}
+
+// runningProcesses identifies processes with the given pids. Processes
+// that have already exited are skipped.
+func runningProcesses(pids ...int) []drainingProcess {
+	var result []drainingProcess
+	for _, pid := range pids {
+		p, err := newDrainingProcess(pid)
+		if err != nil {
+			logger.Printf("generation %d is not running: %v", pid, err)
+			continue
+		}
+		result = append(result, p)
+	}
+	return result
+}
+
+// takeOverDraining remembers ancestors of a parent and the replaced
+// process itself as draining generations and stops the oldest of them
+// if the limit is exceeded. It's called while the parent is waiting
+// for the child, so the pids are not reused yet.
+func (a *App) takeOverDraining(parentDrainingPIDs []int, shutdownPID int) {
+	pids := append([]int{}, parentDrainingPIDs...)
+	if shutdownPID > 0 {
+		pids = append(pids, shutdownPID)
+	}
+	draining := runningProcesses(pids...)
+
+	a.mutex.Lock()
+	a.draining = draining
+	max := a.maxDraining
+	policy := a.escalationPolicy
+	var stopped []drainingProcess
+	if max > 0 && len(draining) > max {
+		stopped = draining[:len(draining)-max]
+	}
+	a.mutex.Unlock()
+
+	for _, p := range stopped {
+		logger.Printf("too many draining generations, stopping %d...", p.pid)
+		go escalate(p, policy)
+	}
+}
+
+// escalate stops a process according to the escalation policy. A
+// signal is sent only if the process is still the same generation.
+func escalate(p drainingProcess, policy EscalationPolicy) {
+	if policy.Signal != nil {
+		if !p.alive() {
+			return
+		}
+		err := signalProcess(p.pid, policy.Signal)
+		if err != nil {
+			logger.Printf("failed to send %v to %d: %v", policy.Signal, p.pid, err)
+		}
+		deadline := time.Now().Add(policy.Timeout)
+		for time.Now().Before(deadline) {
+			if !p.alive() {
+				logger.Printf("generation %d has been stopped with %v", p.pid, policy.Signal)
+				return
+			}
+			time.Sleep(time.Millisecond * 100)
+		}
+	}
+	if !p.alive() {
+		return
+	}
+	err := signalProcess(p.pid, syscall.SIGKILL)
+	logger.Printf("generation %d has been killed with: %v", p.pid, err)
+}
+
+func signalProcess(pid int, s os.Signal) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return p.Signal(s)
+}
@@ -0,0 +1,36 @@
+// Copyright 2017 Grigory Zubankov. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+//
+// +build darwin
+
+package zerodt
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// Size of kinfo_proc on 64-bit platforms.
+const sizeofKinfoProc = 648
+
+// processStartTime returns the start time of a process in
+// microseconds. It fails if there is no such process.
+func processStartTime(pid int) (int64, error) {
+	// CTL_KERN, KERN_PROC, KERN_PROC_PID.
+	mib := [4]int32{1, 14, 1, int32(pid)}
+	buf := make([]byte, sizeofKinfoProc)
+	n := uintptr(len(buf))
+	_, _, errno := syscall.Syscall6(syscall.SYS___SYSCTL, uintptr(unsafe.Pointer(&mib[0])), uintptr(len(mib)), uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&n)), 0, 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	// Nothing is returned for a process that does not exist.
+	if n < sizeofKinfoProc {
+		return 0, syscall.ESRCH
+	}
+	// kinfo_proc starts with p_starttime of struct timeval.
+	sec := *(*int64)(unsafe.Pointer(&buf[0]))
+	usec := *(*int32)(unsafe.Pointer(&buf[8]))
+	return sec*1000000 + int64(usec), nil
+}
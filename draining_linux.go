@@ -0,0 +1,33 @@
+// Copyright 2017 Grigory Zubankov. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+//
+// +build linux
+
+package zerodt
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// processStartTime returns the start time of a process in clock ticks
+// since boot. It fails if there is no such process.
+func processStartTime(pid int) (int64, error) {
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	// A command name may contain spaces and parentheses. The rest of
+	// fields follow the last parenthesis starting with the 3rd one.
+	i := bytes.LastIndexByte(b, ')')
+	fields := strings.Fields(string(b[i+1:]))
+	if i == -1 || len(fields) < 20 {
+		return 0, fmt.Errorf("bad format of /proc/%d/stat", pid)
+	}
+	// The start time is the 22nd field.
+	return strconv.ParseInt(fields[19], 10, 64)
+}
@@ -0,0 +1,36 @@
+// Copyright 2017 Grigory Zubankov. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+//
+// +build linux darwin
+
+package zerodt
+
+import (
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDrainingPIDs(t *testing.T) {
+	cmd := exec.Command("sleep", "30")
+	require.NoError(t, cmd.Start())
+	pid := cmd.Process.Pid
+
+	a := NewApp()
+	a.takeOverDraining(nil, pid)
+	assert.Equal(t, []int{pid}, a.DrainingPIDs())
+
+	// Another process with the same pid is not a draining generation.
+	other := drainingProcess{pid, a.draining[0].start + 1}
+	assert.False(t, other.alive())
+	escalate(other, EscalationPolicy{})
+	assert.True(t, a.draining[0].alive())
+
+	require.NoError(t, cmd.Process.Kill())
+	cmd.Wait()
+	assert.Empty(t, a.DrainingPIDs())
+	assert.Empty(t, a.draining)
+}
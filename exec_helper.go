@@ -0,0 +1,86 @@
+// Copyright 2017 Grigory Zubankov. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+//
+// +build linux darwin
+
+package zerodt
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+const (
+	// A binary the exec helper replaces itself with.
+	envExecPath = "ZERODT_EXEC_PATH"
+)
+
+func init() {
+	execHelper()
+}
+
+// execHelper sets LISTEN_PID to the pid of the current process and
+// replaces the process with a child binary. It does nothing if the
+// process is not started as the exec helper.
+//
+// There is no way in golang to change the environment of a child
+// between fork and exec. So a parent starts its own binary as the
+// helper that fixes the environment and calls exec. The pid does not
+// change with exec, so the child gets its real pid in LISTEN_PID. The
+// helper runs before the code of the app, but after initialization of
+// the packages zerodt does not depend on.
+func execHelper() {
+	path := os.Getenv(envExecPath)
+	if path == "" {
+		return
+	}
+	os.Unsetenv(envExecPath)
+	if os.Getenv(envListenPID) != "" {
+		os.Setenv(envListenPID, strconv.Itoa(os.Getpid()))
+	}
+	err := syscall.Exec(path, os.Args, os.Environ())
+	// The parent detects the death of the child by the closed socket.
+	fmt.Fprintf(os.Stderr, "zerodt: failed to exec %s: %v\n", path, err)
+	os.Exit(1)
+}
+
+// SetExecHelper enables starting children via the exec helper that
+// sets LISTEN_PID to the real pid of a child. A child gets
+// LISTEN_PID=0 otherwise, that is rejected by libraries that follow
+// the systemd's specification strictly.
+//
+// The helper is the current binary started once more. Everything that
+// runs before zerodt's package initialization, e.g. init functions of
+// the packages zerodt does not depend on and initializers of their
+// variables, runs twice in every child: once in the helper and once
+// after exec. Enable the helper only if such code has no side effects
+// like opening log files or registering in external services.
+//
+// Default value is false.
+func (a *App) SetExecHelper(enabled bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.execHelper = enabled
+}
+
+// SetStrictListenPID rejects inherited listeners with LISTEN_PID=0.
+// Such listeners are passed by parents without the exec helper (see
+// SetExecHelper), e.g. by previous versions of zerodt.
+//
+// Default value is false.
+func (a *App) SetStrictListenPID(strict bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.strictListenPID = strict
+}
+
+// execHelperEnv returns an environment variable that makes the exec
+// helper replace itself with the given binary.
+func execHelperEnv(path string) string {
+	return fmt.Sprintf("%s=%s", envExecPath, path)
+}
@@ -0,0 +1,17 @@
+// Copyright 2017 Grigory Zubankov. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+//
+// +build darwin
+
+package zerodt
+
+import (
+	"os"
+)
+
+// selfExecutable returns a path to the binary of the current process.
+// The binary may be already replaced by a new one.
+func selfExecutable() (string, error) {
+	return os.Executable()
+}
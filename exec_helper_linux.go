@@ -0,0 +1,13 @@
+// Copyright 2017 Grigory Zubankov. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+//
+// +build linux
+
+package zerodt
+
+// selfExecutable returns a path to the binary of the current process.
+// It works even if the binary has been replaced or removed.
+func selfExecutable() (string, error) {
+	return "/proc/self/exe", nil
+}
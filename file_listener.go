@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"strconv"
 	"syscall"
 )
 
@@ -41,60 +42,146 @@ import (
 // just before server.Serve() and put it into non-blocking mode by myself.
 // This forces me to open and keep additional file descriptor per each
 // listener, but it's worth it.
+//
+// The same happens with os.File's Fd() function. It puts the file into
+// blocking mode and all duplicates share the mode, including the ones
+// passed to other processes. A parent that starts a child with
+// os.StartProcess blocks its own accept, so Shutdown waits for the next
+// connection and closes it without a response. So the descriptors of
+// duplicated listeners are taken with fileFD instead.
+
+const (
+	// messengerFDName is a name of the communication socket passed
+	// to a child with listeners.
+	messengerFDName = "zerodt-messenger"
+	// pidLockFDName is a name of the locked pid lock file passed to
+	// a process with listeners over the rendezvous socket.
+	pidLockFDName = "zerodt-pidlock"
+	// supervisorFDName is a name of the socket connected to the
+	// supervisor of a worker.
+	supervisorFDName = "zerodt-supervisor"
+)
+
+// extraFile is a file passed to a child out of LISTEN_FDS, since it's
+// not a socket to listen. Its descriptor is passed in env variable.
+type extraFile struct {
+	env string
+	f   *os.File
+}
+
+// inheritExtraFile returns a file passed by a parent in env variable
+// or nil.
+func inheritExtraFile(env string, name string) *os.File {
+	defer os.Unsetenv(env)
+	fd, err := strconv.Atoi(os.Getenv(env))
+	if err != nil || fd < listenFDSStart {
+		return nil
+	}
+	// Do not pass the file to processes started by a client.
+	syscall.CloseOnExec(fd)
+	return os.NewFile(uintptr(fd), name)
+}
+
+// fileFD returns the descriptor of a file without putting it into
+// blocking mode as Fd() does. The file must stay open while the
+// descriptor is in use.
+func fileFD(f *os.File) (int, error) {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+	fd := -1
+	err = rc.Control(func(s uintptr) {
+		fd = int(s)
+	})
+	return fd, err
+}
+
+// isFileFDName checks whether a passed file descriptor with the given
+// name is a file, not a listener.
+func isFileFDName(name string) bool {
+	return name == pidLockFDName
+}
 
 // fileListenerPair describes a pair of a TCPListener and a File.
+// A name is a listener key that identifies a listener across restarts.
 type fileListenerPair struct {
-	l *net.TCPListener
-	f *os.File
+	l    *net.TCPListener
+	f    *os.File
+	name string
 }
 
 // inherit returns all inherited listeners with
-// duplicated file descriptors wrapped in os.File.
+// duplicated file descriptors wrapped in os.File
+// and other inherited files by names.
 // Can be called only once.
-func inherit() ([]*fileListenerPair, *StreamMessenger, error) {
+func inherit(strict bool) ([]*fileListenerPair, *StreamMessenger, map[string]*os.File, error) {
 	// Are there some listeners to inherit?
-	fds, err := listenFds()
+	fds, err := listenFds(strict)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	names, err := listenFdNames(len(fds))
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
-	pairs, cp, err := inheritWithFDS(fds)
+	pairs, cp, files, err := inheritWithFDS(fds, names)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
+	}
+	if f := inheritPIDLock(); f != nil {
+		files[pidLockFDName] = f
+	}
+	if f := inheritExtraFile(envSupervisorFD, supervisorFDName); f != nil {
+		files[supervisorFDName] = f
 	}
 	unsetEnvAll()
-	return pairs, cp, nil
+	return pairs, cp, files, nil
 }
 
-func inheritWithFDS(fds []int) ([]*fileListenerPair, *StreamMessenger, error) {
-	m, err := getMessengerWithFDS(fds)
+func inheritWithFDS(fds []int, names []string) ([]*fileListenerPair, *StreamMessenger, map[string]*os.File, error) {
+	m, err := getMessengerWithFDS(fds, names)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 	if m != nil {
 		fds = fds[0 : len(fds)-1]
 	}
 	// Start to listen them.
-	pairs := make([]*fileListenerPair, len(fds))
+	pairs := make([]*fileListenerPair, 0, len(fds))
+	files := make(map[string]*os.File)
 	for i, fd := range fds {
+		if isFileFDName(names[i]) {
+			// Do not pass the file to processes started by a client.
+			syscall.CloseOnExec(fd)
+			files[names[i]] = os.NewFile(uintptr(fd), names[i])
+			continue
+		}
 		f, err := newFileOnSocket(fd)
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, nil, err
 		}
 		l, err := newFileTCPListener(f)
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, nil, err
 		}
-		pairs[i] = &fileListenerPair{l, f}
+		pairs = append(pairs, &fileListenerPair{l, f, names[i]})
 	}
-	return pairs, m, nil
+	return pairs, m, files, nil
 }
 
-func getMessengerWithFDS(fds []int) (*StreamMessenger, error) {
+func getMessengerWithFDS(fds []int, names []string) (*StreamMessenger, error) {
 	count := len(fds)
 	if count > 0 {
-		ok, err := isSocketTCP(fds[count-1])
-		if err != nil {
-			return nil, err
+		// A communication socket is always the last one. It is detected
+		// by name if names are passed.
+		ok := names[count-1] != messengerFDName
+		if names[count-1] == "" {
+			var err error
+			ok, err = isSocketTCP(fds[count-1])
+			if err != nil {
+				return nil, err
+			}
 		}
 		if !ok {
 			s := os.NewFile(uintptr(fds[count-1]), "s|0")
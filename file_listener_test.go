@@ -19,19 +19,25 @@ import (
 
 func TestInheritedFileListenerPairs(t *testing.T) {
 	setEnv("", "")
-	pairs, _, err := inherit()
+	pairs, _, files, err := inherit(false)
 	require.NoError(t, err)
 	assert.Empty(t, pairs)
+	assert.Empty(t, files)
 }
 
 func TestCreateFileListenerPairs(t *testing.T) {
 	fd := newSocketTCP(t)
 	defer closeFD(t, fd)
 
-	pairs, _, err := inheritWithFDS([]int{fd})
+	ffd := newFile(t)
+
+	pairs, _, files, err := inheritWithFDS([]int{fd, ffd}, []string{"name", pidLockFDName})
 	require.NoError(t, err)
 	assert.Equal(t, 1, len(pairs))
 	assert.NotNil(t, pairs[0].f)
+	assert.Equal(t, "name", pairs[0].name)
+	require.Equal(t, 1, len(files))
+	require.NoError(t, files[pidLockFDName].Close())
 }
 
 func TestSetDefaultGoSocketOptions(t *testing.T) {
@@ -161,3 +167,46 @@ func closeFD(t *testing.T, fd int) {
 	f := os.NewFile(uintptr(fd), "")
 	require.NoError(t, f.Close())
 }
+
+func TestListenersStayNonblocking(t *testing.T) {
+	l := newTCPListener(t)
+	defer l.Close()
+	e := newRegistry(nil)
+	require.NoError(t, e.Register("api", l))
+	files := e.activeFiles()
+	require.True(t, isNonblock(t, l))
+
+	// A child is started with the listener.
+	a := NewApp()
+	a.SetExecHelper(false)
+	pid, f, err := a.forkExec(RestartOptions{Path: "/bin/sh", Args: []string{"-c", "exit 0"}}, files, []string{"api"}, nil, nil)
+	require.NoError(t, err)
+	f.Close()
+	_, err = syscall.Wait4(pid, nil, 0, nil)
+	require.NoError(t, err)
+	assert.True(t, isNonblock(t, l))
+
+	// The listener is sent over a socket.
+	m0, m1 := newMessengerPair(t)
+	defer m0.Close()
+	defer m1.Close()
+	require.NoError(t, m0.SendFiles(typedTestMsg{1}, files...))
+	received, err := m1.RecvFiles(&typedTestMsg{})
+	require.NoError(t, err)
+	closeFiles(received)
+	assert.True(t, isNonblock(t, l))
+}
+
+// isNonblock checks whether a listener is in nonblocking mode. The
+// mode is shared by all duplicates of the listener.
+func isNonblock(t *testing.T, l *net.TCPListener) bool {
+	rc, err := l.SyscallConn()
+	require.NoError(t, err)
+	var flags uintptr
+	var errno syscall.Errno
+	require.NoError(t, rc.Control(func(fd uintptr) {
+		flags, _, errno = syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_GETFL, 0)
+	}))
+	require.Zero(t, errno)
+	return flags&syscall.O_NONBLOCK != 0
+}
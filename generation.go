@@ -0,0 +1,106 @@
+// Copyright 2017 Grigory Zubankov. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+//
+
+package zerodt
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"time"
+)
+
+const (
+	// Restart metadata passed to a child as JSON.
+	envRestart = "ZERODT_RESTART"
+)
+
+// RestartTrigger describes what has started a restart.
+type RestartTrigger string
+
+const (
+	// TriggerSignal means a restart was started by SIGUSR2.
+	TriggerSignal RestartTrigger = "signal"
+	// TriggerAPI means a restart was started by calling App.Restart
+	// or one of its variants.
+	TriggerAPI RestartTrigger = "api"
+	// TriggerControl means a restart was started by a control command.
+	TriggerControl RestartTrigger = "control"
+	// TriggerSupervisor means a worker was started by a supervisor,
+	// e.g. instead of a crashed one.
+	TriggerSupervisor RestartTrigger = "supervisor"
+	// TriggerRendezvous means a process started independently has
+	// connected to the rendezvous socket.
+	TriggerRendezvous RestartTrigger = "rendezvous"
+)
+
+// GenerationInfo describes the generation of the current process and
+// the restart that has started it.
+type GenerationInfo struct {
+	// Generation is 1 for the first process and is incremented on
+	// every restart.
+	Generation int
+	// ParentPID is a pid of a process that has started the current
+	// one during a restart. It is 0 for the first generation.
+	ParentPID int
+	// Trigger and Reason are empty for the first generation.
+	Trigger RestartTrigger
+	Reason  string
+	// Time is the time a restart was requested or the start time for
+	// the first generation.
+	Time time.Time
+}
+
+type generationKey struct{}
+
+// GenerationFromContext returns the generation of a process that
+// serves a request. The context of every request served by App
+// carries it.
+func GenerationFromContext(ctx context.Context) (GenerationInfo, bool) {
+	info, ok := ctx.Value(generationKey{}).(GenerationInfo)
+	return info, ok
+}
+
+func contextWithGeneration(ctx context.Context, info GenerationInfo) context.Context {
+	return context.WithValue(ctx, generationKey{}, info)
+}
+
+// withGeneration wraps http.Server.BaseContext to add the generation
+// to the context of every request.
+func withGeneration(next func(net.Listener) context.Context, info GenerationInfo) func(net.Listener) context.Context {
+	return func(l net.Listener) context.Context {
+		ctx := context.Background()
+		if next != nil {
+			ctx = next(l)
+		}
+		return contextWithGeneration(ctx, info)
+	}
+}
+
+// restartEnv returns an environment variable that passes the restart
+// metadata to a child.
+func restartEnv(info GenerationInfo) string {
+	return envRestart + "=" + encodeGenerationInfo(info)
+}
+
+func encodeGenerationInfo(info GenerationInfo) string {
+	// There is nothing to fail here.
+	b, _ := json.Marshal(info)
+	return string(b)
+}
+
+// generationInfoFromEnv returns the restart metadata passed by a parent
+// or describes the first generation.
+func generationInfoFromEnv(generation int, startTime time.Time) GenerationInfo {
+	defer os.Unsetenv(envRestart)
+	info := GenerationInfo{}
+	err := json.Unmarshal([]byte(os.Getenv(envRestart)), &info)
+	if err != nil || generation == 1 {
+		return GenerationInfo{Generation: generation, Time: startTime}
+	}
+	info.Generation = generation
+	return info
+}
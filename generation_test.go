@@ -0,0 +1,47 @@
+// Copyright 2017 Grigory Zubankov. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+//
+
+package zerodt
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerationInfoFromEnv(t *testing.T) {
+	now := time.Now()
+	info := GenerationInfo{Generation: 3, ParentPID: 42, Trigger: TriggerSignal, Reason: "deploy", Time: now}
+	kv := strings.SplitN(restartEnv(info), "=", 2)
+	assert.Equal(t, envRestart, kv[0])
+	os.Setenv(kv[0], kv[1])
+
+	// The generation number comes from ZERODT_GENERATION.
+	restored := generationInfoFromEnv(4, time.Now())
+	assert.Equal(t, 4, restored.Generation)
+	assert.Equal(t, 42, restored.ParentPID)
+	assert.Equal(t, TriggerSignal, restored.Trigger)
+	assert.Equal(t, "deploy", restored.Reason)
+	assert.True(t, now.Equal(restored.Time))
+	assert.Equal(t, "", os.Getenv(envRestart))
+
+	// The first generation.
+	assert.Equal(t, GenerationInfo{Generation: 1, Time: now}, generationInfoFromEnv(1, now))
+}
+
+func TestGenerationFromContext(t *testing.T) {
+	_, ok := GenerationFromContext(context.Background())
+	assert.False(t, ok)
+
+	info := GenerationInfo{Generation: 2, ParentPID: 42}
+	ctx := withGeneration(nil, info)(nil)
+	restored, ok := GenerationFromContext(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, info, restored)
+}
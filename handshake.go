@@ -0,0 +1,123 @@
+// Copyright 2017 Grigory Zubankov. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+//
+// +build linux darwin
+
+package zerodt
+
+import (
+	"fmt"
+)
+
+// Handshake protocol versions. The version is negotiated with the first
+// exchange: a child offers a range of versions in readyMsg and a parent
+// chooses one in readyConfirmationMsg. A peer that sends no version
+// speaks the 0.1 protocol that is version 1. Both protocols have the
+// same sequence of messages, so fields unknown to a 0.1 peer are just
+// ignored by it.
+const (
+	// The 0.1 protocol.
+	protocolV1 = 1
+	// Negotiation, capabilities and errors.
+	protocolV2 = 2
+)
+
+// Capabilities of a peer. The negotiated ones are the capabilities that
+// both peers have.
+const (
+	// The child kills readyConfirmationMsg.ShutdownPID instead of the
+	// parent on timeout.
+	capShutdownPID = "shutdown-pid"
+	// The child keeps readyConfirmationMsg.DrainingPIDs.
+	capDrainingPIDs = "draining-pids"
+	// Messages after the first exchange are sent in v2 frames. The
+	// first exchange uses v1 frames that a 0.1 peer understands.
+	capFrameV2 = "frame-v2"
+	// The parent sends heartbeatMsg while it is shutting down. It
+	// needs v2 frames to tell a heartbeat from shutdownConfirmationMsg.
+	capHeartbeat = "heartbeat"
+)
+
+// Types of handshake messages. A v2 frame carries the type, so a peer
+// detects messages sent out of order.
+const (
+	readyMsgType uint16 = iota + 1
+	readyConfirmationMsgType
+	acceptedMsgType
+	shutdownConfirmationMsgType
+	rendezvousRequestMsgType
+	rendezvousMsgType
+	rpcMsgType
+	heartbeatMsgType
+)
+
+func (readyMsg) MessageType() uint16                { return readyMsgType }
+func (readyConfirmationMsg) MessageType() uint16    { return readyConfirmationMsgType }
+func (acceptedMsg) MessageType() uint16             { return acceptedMsgType }
+func (shutdownConfirmationMsg) MessageType() uint16 { return shutdownConfirmationMsgType }
+func (rendezvousRequestMsg) MessageType() uint16    { return rendezvousRequestMsgType }
+func (rendezvousMsg) MessageType() uint16           { return rendezvousMsgType }
+func (rpcMsg) MessageType() uint16                  { return rpcMsgType }
+func (heartbeatMsg) MessageType() uint16            { return heartbeatMsgType }
+
+// protocolOffer describes versions and capabilities of a peer.
+type protocolOffer struct {
+	Version      int
+	MinVersion   int
+	Capabilities []string
+}
+
+// localProtocol is the protocol of the current process.
+var localProtocol = protocolOffer{
+	Version:      protocolV2,
+	MinVersion:   protocolV1,
+	Capabilities: []string{capShutdownPID, capDrainingPIDs, capFrameV2, capHeartbeat},
+}
+
+// normalize treats an offer without a version as the 0.1 protocol.
+func (o protocolOffer) normalize() protocolOffer {
+	if o.Version == 0 {
+		return protocolOffer{Version: protocolV1, MinVersion: protocolV1}
+	}
+	if o.MinVersion == 0 || o.MinVersion > o.Version {
+		o.MinVersion = o.Version
+	}
+	return o
+}
+
+// accepts checks if a version is in the range of the offer.
+func (o protocolOffer) accepts(version int) bool {
+	return version >= o.MinVersion && version <= o.Version
+}
+
+// has checks if the offer has a capability.
+func (o protocolOffer) has(capability string) bool {
+	for _, c := range o.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateProtocol chooses the highest version both peers accept and
+// the capabilities both peers have.
+func negotiateProtocol(local, remote protocolOffer) (protocolOffer, *ProtocolError) {
+	local = local.normalize()
+	remote = remote.normalize()
+	version := local.Version
+	if remote.Version < version {
+		version = remote.Version
+	}
+	if !local.accepts(version) || !remote.accepts(version) {
+		return protocolOffer{}, &ProtocolError{fmt.Sprintf("versions %d-%d and %d-%d have nothing in common", local.MinVersion, local.Version, remote.MinVersion, remote.Version)}
+	}
+	result := protocolOffer{Version: version, MinVersion: version}
+	for _, c := range local.Capabilities {
+		if remote.has(c) {
+			result.Capabilities = append(result.Capabilities, c)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,231 @@
+// Copyright 2017 Grigory Zubankov. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+//
+// +build linux darwin
+
+package zerodt
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newMessengerPair(t *testing.T) (*StreamMessenger, *StreamMessenger) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	require.NoError(t, err)
+	m0, err := ListenSocket(os.NewFile(uintptr(fds[0]), "s|0"))
+	require.NoError(t, err)
+	m1, err := ListenSocket(os.NewFile(uintptr(fds[1]), "s|1"))
+	require.NoError(t, err)
+	return m0, m1
+}
+
+func TestNegotiateProtocol(t *testing.T) {
+	// A 0.1 peer.
+	p, err := negotiateProtocol(localProtocol, protocolOffer{})
+	require.Nil(t, err)
+	assert.Equal(t, protocolOffer{Version: protocolV1, MinVersion: protocolV1}, p)
+
+	// A newer peer.
+	p, err = negotiateProtocol(localProtocol, protocolOffer{Version: 5, MinVersion: 2, Capabilities: []string{"x", capShutdownPID}})
+	require.Nil(t, err)
+	assert.Equal(t, protocolV2, p.Version)
+	assert.Equal(t, []string{capShutdownPID}, p.Capabilities)
+
+	// A peer that dropped all known versions.
+	_, err = negotiateProtocol(localProtocol, protocolOffer{Version: 5, MinVersion: 3})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "nothing in common")
+}
+
+func TestHandshake(t *testing.T) {
+	mp, mc := newMessengerPair(t)
+
+	var drainingPIDs []int
+	var shutdownPID int
+	childErr := make(chan error, 1)
+	go func() {
+		childErr <- protocolActAsChild(context.Background(), mc, time.Second*5, 0, 0, func(d []int, s int) {
+			drainingPIDs = d
+			shutdownPID = s
+		}, nil)
+	}()
+	shutdown := false
+	err := protocolActAsParent(context.Background(), mp, time.Second*5, 0, []int{42}, -1, nil, func() { shutdown = true })
+	require.NoError(t, err)
+	require.NoError(t, <-childErr)
+	assert.True(t, shutdown)
+	assert.Equal(t, []int{42}, drainingPIDs)
+	assert.Equal(t, -1, shutdownPID)
+	// Both peers have switched to v2 frames after the first exchange.
+	assert.Equal(t, FrameV2, mp.frameVersion)
+	assert.Equal(t, FrameV2, mc.frameVersion)
+}
+
+func TestHandshakeWithOldChild(t *testing.T) {
+	mp, mc := newMessengerPair(t)
+	defer mc.Close()
+
+	// A 0.1 child can't shutdown another process instead of the parent.
+	require.NoError(t, mc.Send(struct{ WaitParentShutdownTimeout time.Duration }{}))
+	err := protocolActAsParent(context.Background(), mp, time.Second*5, 0, nil, 42, nil, func() { t.Fatal("parent must not shutdown") })
+	require.IsType(t, &ProtocolError{}, err)
+
+	// The child gets EOF instead of a confirmation.
+	rcr := readyConfirmationMsg{}
+	assert.Error(t, mc.Recv(&rcr))
+}
+
+func TestHandshakeHandoffWithOldChild(t *testing.T) {
+	mp, mc := newMessengerPair(t)
+	defer mc.Close()
+
+	// A 0.1 child replaces the parent the same way handoff asks for.
+	require.NoError(t, mc.Send(struct{ WaitParentShutdownTimeout time.Duration }{}))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		rcr := struct{ FixedWaitParentShutdownTimeout time.Duration }{}
+		assert.NoError(t, mc.Recv(&rcr))
+		assert.NoError(t, mc.Send(struct{}{}))
+	}()
+	shutdown := false
+	err := protocolActAsParent(context.Background(), mp, time.Second*5, 0, []int{42}, os.Getpid(), nil, func() { shutdown = true })
+	require.NoError(t, err)
+	assert.True(t, shutdown)
+	<-done
+}
+
+func TestHandshakeWithIncompatibleChild(t *testing.T) {
+	mp, mc := newMessengerPair(t)
+	defer mc.Close()
+
+	require.NoError(t, mc.Send(readyMsg{ProtocolVersion: 5, MinProtocolVersion: 3}))
+	err := protocolActAsParent(context.Background(), mp, time.Second*5, 0, nil, 0, nil, func() { t.Fatal("parent must not shutdown") })
+	require.IsType(t, &ProtocolError{}, err)
+
+	rcr := readyConfirmationMsg{}
+	require.NoError(t, mc.Recv(&rcr))
+	assert.Contains(t, rcr.Error, "nothing in common")
+}
+
+func TestHandshakeWithOldParent(t *testing.T) {
+	mp, mc := newMessengerPair(t)
+	defer mp.Close()
+
+	childErr := make(chan error, 1)
+	notified := false
+	go func() {
+		childErr <- protocolActAsChild(context.Background(), mc, time.Second*5, 0, 0, func([]int, int) { notified = true }, nil)
+	}()
+
+	// A 0.1 parent ignores the version and sends no version back.
+	r := readyMsg{}
+	require.NoError(t, mp.Recv(&r))
+	assert.Equal(t, protocolV2, r.ProtocolVersion)
+	require.NoError(t, mp.Send(struct{ FixedWaitParentShutdownTimeout time.Duration }{}))
+	a := acceptedMsg{}
+	require.NoError(t, mp.Recv(&a))
+	assert.Empty(t, a.Error)
+	require.NoError(t, <-childErr)
+	assert.True(t, notified)
+}
+
+func TestHandshakeWithIncompatibleParent(t *testing.T) {
+	mp, mc := newMessengerPair(t)
+	defer mp.Close()
+
+	childErr := make(chan error, 1)
+	go func() {
+		childErr <- protocolActAsChild(context.Background(), mc, time.Second*5, 0, 0, func([]int, int) { t.Error("child must not take over") }, nil)
+	}()
+
+	r := readyMsg{}
+	require.NoError(t, mp.Recv(&r))
+	require.NoError(t, mp.Send(readyConfirmationMsg{Error: "go away"}))
+	err := <-childErr
+	require.IsType(t, &ProtocolError{}, err)
+	assert.Contains(t, err.Error(), "go away")
+}
+
+func TestHandshakeCancel(t *testing.T) {
+	mp, mc := newMessengerPair(t)
+	defer mc.Close()
+
+	// A silent child does not block the parent until the timeout.
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		cancel()
+	}()
+	started := time.Now()
+	err := protocolActAsParent(ctx, mp, time.Second*30, 0, nil, 0, nil, func() { t.Fatal("parent must not shutdown") })
+	assert.Equal(t, context.Canceled, err)
+	assert.True(t, time.Since(started) < time.Second*5)
+}
+
+func TestHandshakeHeartbeats(t *testing.T) {
+	mp, mc := newMessengerPair(t)
+
+	reports := make(chan DrainReport, 100)
+	childErr := make(chan error, 1)
+	go func() {
+		childErr <- protocolActAsChild(context.Background(), mc, time.Second*5, time.Second*5, time.Millisecond*50, func([]int, int) {}, func(r DrainReport) {
+			reports <- r
+		})
+	}()
+	// A drain takes longer than several heartbeat intervals.
+	err := protocolActAsParent(context.Background(), mp, time.Second*5, 0, nil, -1, func() DrainReport {
+		return DrainReport{PID: 42, DrainProgress: DrainProgress{OpenConnections: 2, InFlightRequests: 1}}
+	}, func() { time.Sleep(time.Millisecond * 500) })
+	require.NoError(t, err)
+	require.NoError(t, <-childErr)
+	require.True(t, len(reports) > 2)
+	r := <-reports
+	assert.Equal(t, 42, r.PID)
+	assert.Equal(t, 2, r.OpenConnections)
+	assert.Equal(t, 1, r.InFlightRequests)
+}
+
+func TestHandshakeMissedHeartbeats(t *testing.T) {
+	mp, mc := newMessengerPair(t)
+	defer mp.Close()
+
+	hung := exec.Command("sleep", "30")
+	require.NoError(t, hung.Start())
+
+	childErr := make(chan error, 1)
+	go func() {
+		childErr <- protocolActAsChild(context.Background(), mc, time.Second*5, time.Second*30, time.Millisecond*50, func([]int, int) {}, nil)
+	}()
+	r := readyMsg{}
+	require.NoError(t, mp.Recv(&r))
+	assert.Equal(t, time.Millisecond*50, r.HeartbeatInterval)
+	mp.SetFrameVersion(FrameV1)
+	require.NoError(t, mp.Send(readyConfirmationMsg{
+		ProtocolVersion:                protocolV2,
+		Capabilities:                   []string{capShutdownPID, capFrameV2, capHeartbeat},
+		FixedWaitParentShutdownTimeout: time.Second * 30,
+		ShutdownPID:                    hung.Process.Pid,
+		HeartbeatInterval:              time.Millisecond * 50,
+	}))
+	a := acceptedMsg{}
+	require.NoError(t, mp.Recv(&a))
+
+	// The hung process is killed long before the shutdown timeout.
+	select {
+	case err := <-childErr:
+		require.NoError(t, err)
+	case <-time.After(time.Second * 5):
+		t.Fatal("the child waits for the hung parent")
+	}
+	assert.Error(t, hung.Wait())
+}
@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 )
 
 const (
@@ -18,16 +19,19 @@ const (
 	envListenFDS = "LISTEN_FDS"
 	// Who should handle socket activation.
 	envListenPID = "LISTEN_PID"
+	// Colon-separated names of provided descriptors.
+	envListenFDNames = "LISTEN_FDNAMES"
 
 	// The first passed file descriptor is fd 3.
 	listenFDSStart = 3
-	// There is no easy way in golang to do separate fork/exec in
-	// order to know child pid. Use this constant instead.
+	// A wildcard pid. It is passed to a child if there is no exec
+	// helper (see SetExecHelper) to set the real pid.
 	listenPIDDefault = 0
 )
 
 // listenFdsCount returns how many file descriptors have been passed.
-func listenFdsCount() (count int, err error) {
+// The wildcard pid is rejected in strict mode.
+func listenFdsCount(strict bool) (count int, err error) {
 	pidStr := os.Getenv(envListenPID)
 	// Normal exit - nothing to listen.
 	if pidStr == "" {
@@ -39,6 +43,10 @@ func listenFdsCount() (count int, err error) {
 		return
 	}
 	// Is this for us?
+	if pid == listenPIDDefault && strict {
+		err = fmt.Errorf("bad environment variable: %s=%d in strict mode", envListenPID, pid)
+		return
+	}
 	if pid != listenPIDDefault && pid != os.Getpid() {
 		err = fmt.Errorf("bad environment variable: %s=%d with pid=%d", envListenPID, pid, os.Getpid())
 		return
@@ -61,8 +69,8 @@ func listenFdsCount() (count int, err error) {
 }
 
 // listenFds returns all inherited file descriptors.
-func listenFds() ([]int, error) {
-	count, err := listenFdsCount()
+func listenFds(strict bool) ([]int, error) {
+	count, err := listenFdsCount(strict)
 	if err != nil {
 		return nil, err
 	}
@@ -73,10 +81,33 @@ func listenFds() ([]int, error) {
 	return fds, nil
 }
 
-func prepareEnv(count int) []string {
+// listenFdNames returns names of all inherited file descriptors. Names
+// are empty if they were not passed.
+func listenFdNames(count int) ([]string, error) {
+	names := make([]string, count)
+	namesStr := os.Getenv(envListenFDNames)
+	if namesStr == "" {
+		return names, nil
+	}
+	parts := strings.Split(namesStr, ":")
+	if len(parts) != count {
+		return nil, fmt.Errorf("bad environment variable: %s=%s with %s=%d", envListenFDNames, namesStr, envListenFDS, count)
+	}
+	for i, p := range parts {
+		names[i] = decodeFDName(p)
+	}
+	return names, nil
+}
+
+func prepareEnv(names []string) []string {
+	encoded := make([]string, len(names))
+	for i, name := range names {
+		encoded[i] = encodeFDName(name)
+	}
 	env := os.Environ()
-	env = append(env, fmt.Sprintf("%s=%d", envListenFDS, count))
+	env = append(env, fmt.Sprintf("%s=%d", envListenFDS, len(names)))
 	env = append(env, fmt.Sprintf("%s=%d", envListenPID, listenPIDDefault))
+	env = append(env, fmt.Sprintf("%s=%s", envListenFDNames, strings.Join(encoded, ":")))
 	return env
 }
 
@@ -84,4 +115,20 @@ func unsetEnvAll() {
 	// Ignore Unsetenv errors.
 	os.Unsetenv(envListenPID)
 	os.Unsetenv(envListenFDS)
+	os.Unsetenv(envListenFDNames)
+}
+
+var (
+	// A colon is a separator in LISTEN_FDNAMES. Listener names are
+	// based on addresses, so they need to be escaped.
+	fdNameEncoder = strings.NewReplacer("%", "%25", ":", "%3A")
+	fdNameDecoder = strings.NewReplacer("%3A", ":", "%25", "%")
+)
+
+func encodeFDName(name string) string {
+	return fdNameEncoder.Replace(name)
+}
+
+func decodeFDName(name string) string {
+	return fdNameDecoder.Replace(name)
 }
@@ -18,83 +18,115 @@ import (
 
 func TestPrepareEnv(t *testing.T) {
 	os.Setenv("TEST_PREPARE_ENV", "EXISTS")
-	env := prepareEnv(7)
+	env := prepareEnv([]string{"a", "b", "c", ":8080", "127.0.0.1:0#1", "%", ""})
 	if len(env) < 3 {
 		t.Fail()
 	}
 	assert.NotEmpty(t, stringInSlice(env, "LISTEN_FDS=7"))
 	assert.NotEmpty(t, stringInSlice(env, "LISTEN_PID=0"))
+	assert.NotEmpty(t, stringInSlice(env, "LISTEN_FDNAMES=a:b:c:%3A8080:127.0.0.1%3A0#1:%25:"))
 	assert.NotEmpty(t, stringInSlice(env, "TEST_PREPARE_ENV=EXISTS"))
 }
 
+func TestListenFdNames(t *testing.T) {
+	// No names
+	setEnv("", "")
+	names, err := listenFdNames(2)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"", ""}, names)
+
+	// Escaped names
+	os.Setenv(envListenFDNames, "%3A8080:%253A")
+	names, err = listenFdNames(2)
+	require.NoError(t, err)
+	assert.Equal(t, []string{":8080", "%3A"}, names)
+
+	// Bad count
+	_, err = listenFdNames(3)
+	assertErr(t, err, "^bad environment variable: LISTEN_FDNAMES=%3A8080:%253A with LISTEN_FDS=3$")
+	unsetEnvAll()
+}
+
 func TestUnsetEnvAll(t *testing.T) {
 	os.Setenv("LISTEN_FDS", "7")
 	os.Setenv("LISTEN_PID", "0")
+	os.Setenv("LISTEN_FDNAMES", "a:b")
 
 	unsetEnvAll()
 	assert.Equal(t, "", os.Getenv("LISTEN_FDS"))
 	assert.Equal(t, "", os.Getenv("LISTEN_PID"))
+	assert.Equal(t, "", os.Getenv("LISTEN_FDNAMES"))
 }
 
 func TestListenFdsCount(t *testing.T) {
 	// Normal exit without activation
 	setEnv("", "")
-	count, err := listenFdsCount()
+	count, err := listenFdsCount(false)
 	require.NoError(t, err)
 	assert.Equal(t, 0, count)
 
 	// Bad LISTEN_PID
 	setEnv("not a pid", "")
-	count, err = listenFdsCount()
+	count, err = listenFdsCount(false)
 	assertErr(t, err, "^bad environment variable: LISTEN_PID=not a pid$")
 
 	setEnv("1", "")
-	count, err = listenFdsCount()
+	count, err = listenFdsCount(false)
 	assertErr(t, err, fmt.Sprintf("^bad environment variable: LISTEN_PID=1 with pid=%d$", os.Getpid()))
 
 	// No LISTEN_FDS
 	setEnv(strconv.Itoa(os.Getpid()), "")
-	count, err = listenFdsCount()
+	count, err = listenFdsCount(false)
 	assertErr(t, err, "^mandatory environment variable does not exist: LISTEN_FDS$")
 
 	// Bad LISTEN_FDS
 	setEnv(strconv.Itoa(os.Getpid()), "not a number")
-	count, err = listenFdsCount()
+	count, err = listenFdsCount(false)
 	assertErr(t, err, fmt.Sprintf("^bad environment variable: LISTEN_FDS=not a number$"))
 
 	setEnv(strconv.Itoa(os.Getpid()), "-2")
-	count, err = listenFdsCount()
+	count, err = listenFdsCount(false)
 	assertErr(t, err, fmt.Sprintf("^bad environment variable: LISTEN_FDS=-2$"))
 
 	// All ok
 	setEnv(strconv.Itoa(os.Getpid()), "7")
-	count, err = listenFdsCount()
+	count, err = listenFdsCount(false)
 	require.NoError(t, err)
 	assert.Equal(t, 7, count)
 
 	// All ok with default LISTEN_PID
 	setEnv("0", "148")
-	count, err = listenFdsCount()
+	count, err = listenFdsCount(false)
 	require.NoError(t, err)
 	assert.Equal(t, 148, count)
+
+	// Strict mode
+	count, err = listenFdsCount(true)
+	assertErr(t, err, "^bad environment variable: LISTEN_PID=0 in strict mode$")
+
+	setEnv(strconv.Itoa(os.Getpid()), "7")
+	count, err = listenFdsCount(true)
+	require.NoError(t, err)
+	assert.Equal(t, 7, count)
+	unsetEnvAll()
 }
 
 func TestListenFds(t *testing.T) {
 	// Normal exit without activation
 	setEnv("", "")
-	fds, err := listenFds()
+	fds, err := listenFds(false)
 	require.NoError(t, err)
 	assert.Equal(t, 0, len(fds))
 
 	// Normal exit with activation
 	setEnv("0", "2")
-	fds, err = listenFds()
+	fds, err = listenFds(false)
 	require.NoError(t, err)
 	assert.Equal(t, []int{3, 4}, fds)
 
 	// Bad env
 	setEnv("not a pid", "")
-	_, err = listenFds()
+	_, err = listenFds(false)
 	assert.Error(t, err)
 }
 
@@ -0,0 +1,47 @@
+// Copyright 2017 Grigory Zubankov. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+//
+// +build darwin
+
+package zerodt
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// xucred is struct xucred returned by LOCAL_PEERCRED.
+type xucred struct {
+	version uint32
+	uid     uint32
+	ngroups int16
+	groups  [16]uint32
+}
+
+// peerCred returns a uid of a connected process. The pid is 0 since
+// there are no pid namespaces, the pid reported by a process is used.
+func peerCred(c *net.UnixConn) (int, int, error) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return 0, 0, err
+	}
+	cred := xucred{}
+	var credErr error
+	err = rc.Control(func(fd uintptr) {
+		// SOL_LOCAL, LOCAL_PEERCRED.
+		n := uintptr(unsafe.Sizeof(cred))
+		_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, 0, 1, uintptr(unsafe.Pointer(&cred)), uintptr(unsafe.Pointer(&n)), 0)
+		if errno != 0 {
+			credErr = errno
+		}
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	if credErr != nil {
+		return 0, 0, credErr
+	}
+	return 0, int(cred.uid), nil
+}
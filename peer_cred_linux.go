@@ -0,0 +1,33 @@
+// Copyright 2017 Grigory Zubankov. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+//
+// +build linux
+
+package zerodt
+
+import (
+	"net"
+	"syscall"
+)
+
+// peerCred returns a pid and a uid of a connected process. The pid is
+// seen in the current pid namespace.
+func peerCred(c *net.UnixConn) (int, int, error) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return 0, 0, err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	err = rc.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	if credErr != nil {
+		return 0, 0, credErr
+	}
+	return int(cred.Pid), int(cred.Uid), nil
+}
@@ -0,0 +1,118 @@
+// Copyright 2017 Grigory Zubankov. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+//
+// +build linux darwin
+
+package zerodt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	// A descriptor of the pid lock file passed to a child. It follows
+	// the descriptors of LISTEN_FDS.
+	envPIDLockFD = "ZERODT_PID_LOCK_FD"
+)
+
+// SetPIDFile sets a path to a pid file. The file is locked with flock
+// to prevent two unrelated instances from starting. A child inherits
+// the lock and takes the file over when it starts serving. The file is
+// removed on the final shutdown only.
+//
+// The lock is placed on a separate file with ".lock" suffix, because
+// the pid file itself is atomically replaced. The lock file is never
+// removed. Otherwise another instance could lock a new file while
+// somebody holds the lock of the removed one.
+//
+// Default value is empty that means no pid file.
+func (a *App) SetPIDFile(path string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.pidFile = path
+}
+
+// lockPIDFile locks the pid lock file or reuses the inherited one
+// that is already locked by the parent.
+func (a *App) lockPIDFile(inherited *os.File) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	// A supervisor owns the pid file of its workers.
+	if a.pidFile == "" || a.masterPID != 0 {
+		if inherited != nil {
+			inherited.Close()
+		}
+		return nil
+	}
+	f := inherited
+	if f == nil {
+		var err error
+		f, err = os.OpenFile(a.pidFile+".lock", os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	// The inherited file shares the lock with the parent, so it's
+	// locked successfully.
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return fmt.Errorf("pid file %s is locked by another instance with pid=%d", a.pidFile, readPIDFile(a.pidFile))
+		}
+		return err
+	}
+	a.pidLock = f
+	return nil
+}
+
+// writePIDFile writes the current pid to the pid file if the current
+// process owns it. It must be called with mutex held.
+func (a *App) writePIDFile() {
+	if a.pidFile == "" || !a.owner {
+		return
+	}
+	err := writeFileAtomic(a.pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+	if err != nil {
+		logger.Printf("failed to write pid file with: %v", err)
+	}
+}
+
+// removePIDFile removes the pid file if the current process owns it and
+// releases the lock. It must be called with mutex held.
+func (a *App) removePIDFile() {
+	if a.pidLock == nil {
+		return
+	}
+	if a.owner {
+		os.Remove(a.pidFile)
+	}
+	a.pidLock.Close()
+	a.pidLock = nil
+}
+
+// inheritPIDLock returns the pid lock file passed by a parent or nil.
+func inheritPIDLock() *os.File {
+	return inheritExtraFile(envPIDLockFD, pidLockFDName)
+}
+
+// readPIDFile returns a pid from the pid file or 0.
+func readPIDFile(path string) int {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
@@ -0,0 +1,83 @@
+// Copyright 2017 Grigory Zubankov. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+//
+// +build linux darwin
+
+package zerodt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPIDFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zerodt-pid-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.pid")
+
+	a := NewApp()
+	a.SetPIDFile(path)
+	require.NoError(t, a.lockPIDFile(nil))
+	a.owner = true
+	a.writePIDFile()
+	assert.Equal(t, os.Getpid(), readPIDFile(path))
+
+	// Another instance can't lock the same file.
+	other := NewApp()
+	other.SetPIDFile(path)
+	err = other.lockPIDFile(nil)
+	assertErr(t, err, fmt.Sprintf("^pid file .* is locked by another instance with pid=%d$", os.Getpid()))
+
+	// The lock is shared with a child that inherits the file.
+	fd, err := syscall.Dup(int(a.pidLock.Fd()))
+	require.NoError(t, err)
+	child := NewApp()
+	child.SetPIDFile(path)
+	require.NoError(t, child.lockPIDFile(os.NewFile(uintptr(fd), pidLockFDName)))
+	child.removePIDFile()
+
+	// Not an owner keeps the files.
+	a.owner = false
+	a.removePIDFile()
+	assert.Equal(t, os.Getpid(), readPIDFile(path))
+	_, err = os.Stat(path + ".lock")
+	assert.NoError(t, err)
+
+	// An owner removes the pid file. The lock file is kept, somebody
+	// may have it open.
+	require.NoError(t, a.lockPIDFile(nil))
+	a.owner = true
+	a.removePIDFile()
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(path + ".lock")
+	assert.NoError(t, err)
+}
+
+func TestInheritPIDLock(t *testing.T) {
+	assert.Nil(t, inheritPIDLock())
+
+	f, err := ioutil.TempFile("", "zerodt-pidlock-")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	fd, err := syscall.Dup(int(f.Fd()))
+	require.NoError(t, err)
+	f.Close()
+
+	os.Setenv(envPIDLockFD, strconv.Itoa(fd))
+	inherited := inheritPIDLock()
+	require.NotNil(t, inherited)
+	assert.EqualValues(t, fd, inherited.Fd())
+	assert.Equal(t, "", os.Getenv(envPIDLockFD))
+	require.NoError(t, inherited.Close())
+}
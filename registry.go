@@ -0,0 +1,308 @@
+// Copyright 2017 Grigory Zubankov. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+//
+// +build linux darwin
+
+package zerodt
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// Registry keeps inherited listeners and the active ones. Inherited
+// listeners are passed by a parent or by systemd. A listener becomes
+// active when it is acquired, created or registered. Only the active
+// listeners are passed to a child.
+//
+// App keeps the listeners of its servers in a registry. A service with
+// its own server loop may use a registry directly (see NewRegistry).
+type Registry struct {
+	inherited []*fileListenerPair
+	active    []*fileListenerPair
+	// Keys of all listeners that are going to be acquired.
+	expected map[string]bool
+	mutex    sync.Mutex
+}
+
+// NewRegistry returns a registry with the listeners passed by systemd
+// or by a custom fork (see Export). It can be called only once.
+//
+// A process started by App must be served by App. Otherwise the parent
+// does not get a confirmation and keeps serving.
+func NewRegistry() (*Registry, error) {
+	pairs, m, files, err := inherit(false)
+	if err != nil {
+		return nil, err
+	}
+	if m != nil {
+		m.Close()
+	}
+	for _, f := range files {
+		f.Close()
+	}
+	return newRegistry(pairs), nil
+}
+
+// Registry returns the registry of a serving app or nil if the app is
+// not serving yet. Listeners registered with it are passed to a child
+// together with the listeners of the servers, so the child can acquire
+// them in PreServeFn.
+func (a *App) Registry() *Registry {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return a.registry
+}
+
+func newRegistry(pairs []*fileListenerPair) *Registry {
+	return &Registry{inherited: pairs, expected: make(map[string]bool)}
+}
+
+// Inherited returns keys and addresses of inherited listeners that are
+// not acquired yet. A key is empty if names are not passed.
+func (r *Registry) Inherited() []ListenerStatus {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	result := []ListenerStatus{}
+	for _, pr := range r.inherited {
+		if pr != nil {
+			result = append(result, ListenerStatus{pr.name, pr.l.Addr().String()})
+		}
+	}
+	return result
+}
+
+// Export returns files of the active listeners and an environment for
+// a child started by a custom fork. The files must be passed as
+// descriptors starting with 3 in the same order, e.g. with
+// syscall.StartProcess. Note that os.StartProcess and exec.Cmd put the
+// files into blocking mode together with the listeners in use (read 'A
+// Lyrical Digression' in file_listener.go).
+//
+// LISTEN_PID is 0 in the environment since the pid of a child is not
+// known before it starts. A child in strict mode (see
+// SetStrictListenPID) rejects it, so a custom fork has to replace it
+// with the pid of the child before the child inherits the listeners,
+// e.g. like the exec helper does (see SetExecHelper).
+func (r *Registry) Export() ([]*os.File, []string) {
+	active := r.activeListeners()
+	files := make([]*os.File, len(active))
+	names := make([]string, len(active))
+	for i, pr := range active {
+		files[i] = pr.f
+		names[i] = pr.name
+	}
+	return files, prepareEnv(names)
+}
+
+// expectKey notifies registry that a listener with the given key is
+// going to be acquired. An inherited listener with this key will not
+// be acquired by address by somebody else.
+func (r *Registry) expectKey(key string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.expected[key] = true
+}
+
+// forgetKey notifies registry that a listener with the given key is
+// not going to be acquired anymore.
+func (r *Registry) forgetKey(key string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.expected, key)
+}
+
+// didInherit checks whether registry contains inherited listeners.
+func (r *Registry) didInherit() bool {
+	return len(r.inherited) > 0
+}
+
+// activeFiles returns an array of files, corresponded to active listeners.
+func (r *Registry) activeFiles() []*os.File {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// Make a separate slice of active files (duped listeners)
+	active := make([]*os.File, len(r.active))
+	for i, pr := range r.active {
+		active[i] = pr.f
+	}
+	return active
+}
+
+// activeListeners returns an array of active listeners with their keys.
+func (r *Registry) activeListeners() []*fileListenerPair {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	active := make([]*fileListenerPair, len(r.active))
+	copy(active, r.active)
+	return active
+}
+
+// Acquire allows to get one of the inherited listeners. A listener is
+// matched by key first. Addresses are compared only if there is no such
+// key and the port is not ephemeral. A listener is matched by key only
+// if addr is nil. It returns nil if there is no such listener.
+func (r *Registry) Acquire(key string, addr *net.TCPAddr) (*net.TCPListener, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	i := r.findInherited(func(pr *fileListenerPair) bool {
+		return key != "" && pr.name == key
+	})
+	if i != -1 {
+		// Keys are stable, addresses are not. A host name can be resolved
+		// to a different IP but a changed port is a configuration error.
+		inheritedAddr := r.inherited[i].l.Addr().(*net.TCPAddr)
+		if addr != nil && addr.Port != 0 && addr.Port != inheritedAddr.Port {
+			return nil, fmt.Errorf("listener %q is inherited with address %v that does not match %v", key, inheritedAddr, addr)
+		}
+	}
+	if i == -1 && addr != nil && addr.Port != 0 {
+		i = r.findInherited(func(pr *fileListenerPair) bool {
+			return equalTCPAddr(addr, pr.l.Addr().(*net.TCPAddr))
+		})
+		// The listener belongs to somebody else. Other names, e.g. set
+		// by systemd, do not prevent matching by address.
+		if i != -1 && r.expected[r.inherited[i].name] {
+			return nil, fmt.Errorf("listener %v is inherited with key %q that does not match %q", addr, r.inherited[i].name, key)
+		}
+	}
+	if i == -1 {
+		return nil, nil
+	}
+
+	// Acquire the socket pair: move it to the active array
+	pr := r.inherited[i]
+	pr.name = key
+	r.active = append(r.active, pr)
+	r.inherited[i] = nil
+	return pr.l, nil
+}
+
+// findInherited returns an index of the first not acquired inherited
+// listener that satisfies fn or -1.
+func (r *Registry) findInherited(fn func(*fileListenerPair) bool) int {
+	for i, pr := range r.inherited {
+		if pr == nil {
+			// This socket pair is already acquired.
+			continue
+		}
+		if fn(pr) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Register duplicates a listener and keeps duplicate.
+// This listener now can be inherited by a child process.
+func (r *Registry) Register(key string, l *net.TCPListener) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// Duplicate a listener. Registry needs a copy of a listener to be
+	// able to pass it to a child.
+	f, err := l.File()
+	if err != nil {
+		return err
+	}
+	// Read 'A Lyrical Digression' in file_listener.go to understand
+	// what's going on.
+	fd, err := fileFD(f)
+	if err == nil {
+		err = syscall.SetNonblock(fd, true)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	// Add a file to the active array. Only files in active array
+	// will be passed to a child.
+	r.active = append(r.active, &fileListenerPair{l, f, key})
+	return nil
+}
+
+// Release removes a listener from the active array and closes
+// its duplicate. The listener itself is not closed and will not be
+// passed to a child anymore.
+func (r *Registry) Release(l *net.TCPListener) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for i, pr := range r.active {
+		if pr.l == l {
+			r.active = append(r.active[:i], r.active[i+1:]...)
+			// Nothing to do with errors.
+			pr.f.Close()
+			return
+		}
+	}
+}
+
+// Listen acquires an inherited listener or creates a new one and adds
+// it to the registry. The key identifies the listener across restarts.
+func (r *Registry) Listen(key, netStr, addrStr string) (*net.TCPListener, error) {
+	addr, err := net.ResolveTCPAddr(netStr, addrStr)
+	if err != nil {
+		return nil, err
+	}
+	if key != "" {
+		r.expectKey(key)
+	}
+
+	// Try to acquire one of inherited listeners.
+	l, err := r.Acquire(key, addr)
+	if err != nil {
+		return nil, err
+	}
+	if l != nil {
+		logger.Printf("listener %v acquired as %v", l.Addr(), addr)
+		return l, nil
+	}
+
+	// Create a new TCP listener and add it to the registry.
+	l, err = net.ListenTCP(netStr, addr)
+	if err != nil {
+		return nil, err
+	}
+	err = r.Register(key, l)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	logger.Printf("listener %v created as %v", l.Addr(), addr)
+
+	return l, nil
+}
+
+func equalTCPAddr(l *net.TCPAddr, r *net.TCPAddr) bool {
+	return true &&
+		// Need to match zones,
+		l.Zone == r.Zone &&
+		// ports,
+		l.Port == r.Port &&
+		// and IPs.
+		bytes.Equal(normalizeIP(l.IP), normalizeIP(r.IP))
+}
+
+func normalizeIP(ip net.IP) net.IP {
+	// net.IP can be nil after ResolveTCPAddr. The same address
+	if ip == nil {
+		return net.IPv6zero
+	}
+	// Note! The only way to compare IPs directly, is to convert
+	// them to a 16-byte representation form before.
+	return ip.To16()
+}
@@ -0,0 +1,205 @@
+// Copyright 2017 Grigory Zubankov. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+//
+// +build linux darwin
+
+package zerodt
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmptyRegistry(t *testing.T) {
+	e := newRegistry(nil)
+	assert.Empty(t, e.inherited)
+	assert.Empty(t, e.activeFiles())
+	assert.Equal(t, false, e.didInherit())
+
+	l := newTCPListener(t)
+	err := e.Register("", l)
+	require.NoError(t, err)
+	assert.Empty(t, e.inherited)
+	assert.Equal(t, 1, len(e.active))
+	assert.NoError(t, l.Close())
+
+	assert.Equal(t, 1, len(e.activeFiles()))
+}
+
+func TestRegistry(t *testing.T) {
+	l := newTCPListener(t)
+	f, err := l.File()
+	require.NoError(t, err)
+
+	e := newRegistry([]*fileListenerPair{{l, f, ""}})
+	assert.Equal(t, 1, len(e.inherited))
+	assert.Empty(t, e.activeFiles())
+	assert.Equal(t, true, e.didInherit())
+
+	l1, err := e.Acquire("", l.Addr().(*net.TCPAddr))
+	require.NoError(t, err)
+	assert.NotNil(t, l1)
+	assert.Empty(t, e.inherited[0])
+	assert.Equal(t, 1, len(e.active))
+	assert.Equal(t, 1, len(e.activeFiles()))
+}
+
+func TestRegistryAcquireByKey(t *testing.T) {
+	l0 := newTCPListener(t)
+	f0, err := l0.File()
+	require.NoError(t, err)
+	l1 := newTCPListener(t)
+	f1, err := l1.File()
+	require.NoError(t, err)
+
+	e := newRegistry([]*fileListenerPair{{l0, f0, ":0"}, {l1, f1, ":0#1"}})
+
+	// An ephemeral port can be acquired only by key.
+	addr, err := net.ResolveTCPAddr("tcp", ":0")
+	require.NoError(t, err)
+	l, err := e.Acquire("unknown", addr)
+	require.NoError(t, err)
+	assert.Nil(t, l)
+	l, err = e.Acquire(":0#1", addr)
+	require.NoError(t, err)
+	assert.Equal(t, l1, l)
+	l, err = e.Acquire(":0", addr)
+	require.NoError(t, err)
+	assert.Equal(t, l0, l)
+	assert.Equal(t, 2, len(e.activeFiles()))
+	assert.Equal(t, ":0#1", e.activeListeners()[0].name)
+}
+
+func TestRegistryAcquireWithoutAddr(t *testing.T) {
+	l0 := newTCPListener(t)
+	defer l0.Close()
+	f0, err := l0.File()
+	require.NoError(t, err)
+
+	e := newRegistry([]*fileListenerPair{{l0, f0, "api"}})
+
+	// A listener is acquired by key only.
+	l, err := e.Acquire("", nil)
+	require.NoError(t, err)
+	assert.Nil(t, l)
+	l, err = e.Acquire("admin", nil)
+	require.NoError(t, err)
+	assert.Nil(t, l)
+	l, err = e.Acquire("api", nil)
+	require.NoError(t, err)
+	assert.Equal(t, l0, l)
+}
+
+func TestRegistryAcquireMismatch(t *testing.T) {
+	l := newTCPListener(t)
+	f, err := l.File()
+	require.NoError(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+
+	e := newRegistry([]*fileListenerPair{{l, f, "api"}})
+	e.expectKey("api")
+
+	// The same key with a different port.
+	_, err = e.Acquire("api", &net.TCPAddr{Port: port + 1})
+	assertErr(t, err, "^listener \"api\" is inherited with address .* that does not match")
+
+	// The same address with a different key.
+	_, err = e.Acquire("admin", &net.TCPAddr{Port: port})
+	assertErr(t, err, "^listener .* is inherited with key \"api\" that does not match \"admin\"$")
+
+	// A listener with an unknown key is matched by address.
+	e = newRegistry([]*fileListenerPair{{l, f, "service.socket"}})
+	l1, err := e.Acquire("admin", &net.TCPAddr{Port: port})
+	require.NoError(t, err)
+	assert.Equal(t, l, l1)
+	assert.Equal(t, "admin", e.activeListeners()[0].name)
+}
+
+func TestRegistryReleaseListener(t *testing.T) {
+	e := newRegistry(nil)
+	l, err := e.Listen("", "tcp", ":0")
+	require.NoError(t, err)
+	defer l.Close()
+	assert.Equal(t, 1, len(e.activeFiles()))
+
+	e.Release(l)
+	assert.Empty(t, e.activeFiles())
+	// The listener itself is still alive.
+	assert.NotNil(t, l.Addr())
+}
+
+func TestRegistryInheritedAndExport(t *testing.T) {
+	l0 := newTCPListener(t)
+	defer l0.Close()
+	f0, err := l0.File()
+	require.NoError(t, err)
+	l1 := newTCPListener(t)
+	defer l1.Close()
+	f1, err := l1.File()
+	require.NoError(t, err)
+
+	e := newRegistry([]*fileListenerPair{{l0, f0, "api"}, {l1, f1, "admin"}})
+	assert.Equal(t, []ListenerStatus{{"api", l0.Addr().String()}, {"admin", l1.Addr().String()}}, e.Inherited())
+
+	l, err := e.Listen("api", "tcp", ":0")
+	require.NoError(t, err)
+	assert.Equal(t, l0, l)
+	assert.Equal(t, []ListenerStatus{{"admin", l1.Addr().String()}}, e.Inherited())
+
+	// An extra listener is passed to a child as well.
+	l2 := newTCPListener(t)
+	defer l2.Close()
+	require.NoError(t, e.Register("extra", l2))
+	files, env := e.Export()
+	require.Len(t, files, 2)
+	assert.Equal(t, f0, files[0])
+	assert.NotEmpty(t, stringInSlice(env, "LISTEN_FDS=2"))
+	assert.NotEmpty(t, stringInSlice(env, "LISTEN_FDNAMES=api:extra"))
+}
+
+func TestNewRegistry(t *testing.T) {
+	defer unsetEnvAll()
+
+	// Nothing is inherited without systemd's variables.
+	unsetEnvAll()
+	e, err := NewRegistry()
+	require.NoError(t, err)
+	assert.Empty(t, e.Inherited())
+	assert.False(t, e.didInherit())
+
+	// The variables of another process are rejected.
+	os.Setenv(envListenPID, strconv.Itoa(os.Getpid()+1))
+	os.Setenv(envListenFDS, "1")
+	_, err = NewRegistry()
+	assert.Error(t, err)
+
+	// An exported environment is accepted without listeners.
+	unsetEnvAll()
+	_, env := newRegistry(nil).Export()
+	for _, kv := range env {
+		if parts := strings.SplitN(kv, "=", 2); strings.HasPrefix(parts[0], "LISTEN_") {
+			os.Setenv(parts[0], parts[1])
+		}
+	}
+	assert.Equal(t, "0", os.Getenv(envListenPID))
+	e, err = NewRegistry()
+	require.NoError(t, err)
+	assert.Empty(t, e.Inherited())
+	// The variables are not passed to processes started by a service.
+	assert.Equal(t, "", os.Getenv(envListenFDS))
+}
+
+func newTCPListener(t *testing.T) *net.TCPListener {
+	addr, err := net.ResolveTCPAddr("tcp", ":0")
+	require.NoError(t, err)
+	l, err := net.ListenTCP("tcp", addr)
+	require.NoError(t, err)
+	return l
+}
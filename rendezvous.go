@@ -0,0 +1,246 @@
+// Copyright 2017 Grigory Zubankov. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+//
+// +build linux darwin
+
+package zerodt
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// rendezvousRequestMsg is sent by a process that connects to the
+// rendezvous socket.
+type rendezvousRequestMsg struct {
+	// PID of the process in its own pid namespace.
+	PID int
+}
+
+// rendezvousMsg is sent with the listeners as SCM_RIGHTS. The usual
+// handshake follows it.
+type rendezvousMsg struct {
+	// Names of the passed files.
+	Names      []string
+	Generation GenerationInfo
+	// Error is set if the running process rejected a restart. No files
+	// are passed in this case.
+	Error string
+}
+
+// SetRendezvousSocket sets a path to a unix socket for processes that
+// are started independently, e.g. by an orchestrator in another
+// container that shares a volume. A starting App connects to the
+// socket and receives the listeners of the running one instead of
+// creating new listeners. The handshake then goes the same way as for
+// a forked child and the running App shuts down. A child takes the
+// socket over when it accepts the listeners.
+//
+// A process in another pid namespace is not killed if it does not
+// shutdown in time and does not track draining generations. The socket
+// is accessible by the owner only, processes of other users except
+// root are rejected.
+//
+// Default value is empty that means no rendezvous socket.
+func (a *App) SetRendezvousSocket(path string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.rendezvousPath = path
+}
+
+// inherit returns listeners passed by a parent or received from a
+// process that listens on the rendezvous socket.
+func (a *App) inherit() ([]*fileListenerPair, *StreamMessenger, map[string]*os.File, error) {
+	a.mutex.Lock()
+	path := a.rendezvousPath
+	worker := a.masterPID != 0
+	strict := a.strictListenPID
+	a.mutex.Unlock()
+	pairs, m, files, err := inherit(strict)
+	if err != nil || m != nil || len(pairs) != 0 {
+		return pairs, m, files, err
+	}
+	if path == "" || worker {
+		return pairs, m, files, err
+	}
+	return a.dialRendezvous(path)
+}
+
+// dialRendezvous receives listeners from a process that listens on the
+// rendezvous socket. Nothing is received if there is no such process.
+func (a *App) dialRendezvous(path string) ([]*fileListenerPair, *StreamMessenger, map[string]*os.File, error) {
+	c, err := net.DialTimeout("unix", path, a.waitChildTimeout)
+	if err != nil {
+		if errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.ECONNREFUSED) {
+			logger.Printf("no process on rendezvous socket %s", path)
+			return nil, nil, nil, nil
+		}
+		return nil, nil, nil, err
+	}
+	m := NewStreamMessenger(c)
+	m.SetDeadline(time.Now().Add(a.waitChildTimeout))
+	err = m.Send(rendezvousRequestMsg{PID: os.Getpid()})
+	if err != nil {
+		m.Close()
+		return nil, nil, nil, err
+	}
+	msg := rendezvousMsg{}
+	received, err := m.RecvFiles(&msg)
+	if err == nil && msg.Error != "" {
+		err = fmt.Errorf("rendezvous rejected: %s", msg.Error)
+	}
+	if err == nil && len(received) != len(msg.Names) {
+		err = fmt.Errorf("rendezvous: %d files received for %d names", len(received), len(msg.Names))
+	}
+	// The files are owned by inheritWithFDS like inherited ones.
+	fds := make([]int, 0, len(received))
+	for _, f := range received {
+		if err != nil {
+			break
+		}
+		var fd int
+		fd, err = fileFD(f)
+		if err == nil {
+			fd, err = syscall.Dup(fd)
+		}
+		if err == nil {
+			fds = append(fds, fd)
+		}
+	}
+	closeFiles(received)
+	var pairs []*fileListenerPair
+	var files map[string]*os.File
+	if err == nil {
+		pairs, _, files, err = inheritWithFDS(fds, msg.Names)
+	}
+	if err != nil {
+		m.Close()
+		return nil, nil, nil, err
+	}
+	// The generation is passed the same way as to a forked child.
+	os.Setenv(envGeneration, strconv.Itoa(msg.Generation.Generation))
+	os.Setenv(envRestart, encodeGenerationInfo(msg.Generation))
+	m.SetDeadline(time.Time{})
+	logger.Printf("received %d listeners from rendezvous socket %s", len(pairs), path)
+	return pairs, m, files, nil
+}
+
+// listenRendezvousSocket starts listening on the rendezvous socket. It
+// must be called with mutex held.
+func (a *App) listenRendezvousSocket() error {
+	if a.rendezvousPath == "" || a.rendezvousListener != nil {
+		return nil
+	}
+	l, err := listenUnixSocket(a.rendezvousPath)
+	if err != nil {
+		return err
+	}
+	a.rendezvousListener = l
+	logger.Printf("listening rendezvous socket %s", a.rendezvousPath)
+
+	go a.acceptRendezvous(l)
+	return nil
+}
+
+// closeRendezvousSocket stops listening on the rendezvous socket. The
+// socket file is removed if the current process owns it. It must be
+// called with mutex held.
+func (a *App) closeRendezvousSocket() {
+	if a.rendezvousListener == nil {
+		return
+	}
+	a.rendezvousListener.Close()
+	a.rendezvousListener = nil
+	if a.owner {
+		os.Remove(a.rendezvousPath)
+	}
+}
+
+func (a *App) acceptRendezvous(l *net.UnixListener) {
+	for {
+		c, err := l.AcceptUnix()
+		if err != nil {
+			// Closed by closeRendezvousSocket.
+			return
+		}
+		a.controlWG.Add(1)
+		go func() {
+			defer a.controlWG.Done()
+			a.serveRendezvous(c)
+		}()
+	}
+}
+
+// serveRendezvous hands the listeners over to a connected process.
+func (a *App) serveRendezvous(c *net.UnixConn) {
+	peer, err := checkPeer(c)
+	if err != nil {
+		logger.Printf("rendezvous connection rejected: %v", err)
+		c.Close()
+		return
+	}
+	m := NewStreamMessenger(c)
+	m.SetDeadline(time.Now().Add(a.waitChildTimeout))
+	req := rendezvousRequestMsg{}
+	err = m.Recv(&req)
+	if err != nil {
+		logger.Printf("failed to receive rendezvous request with: %v", err)
+		m.Close()
+		return
+	}
+	// A peer in another pid namespace has another pid here.
+	pid, sameNS := req.PID, true
+	if peer != 0 && peer != req.PID {
+		pid, sameNS = peer, false
+	}
+	logger.Printf("pid=%d connected to rendezvous socket", pid)
+
+	started := false
+	err = a.runRestart(TriggerRendezvous, fmt.Sprintf("pid %d connected to the rendezvous socket", pid), func(e *Registry, info GenerationInfo) (int, error) {
+		started = true
+		return pid, a.handoffTo(m, e, info, sameNS)
+	})
+	if !started {
+		// The restart has been rejected or coalesced with another one.
+		reason := "another restart is in progress"
+		if err != nil {
+			reason = err.Error()
+		}
+		m.SetDeadline(time.Now().Add(sendTimeout))
+		m.Send(rendezvousMsg{Error: reason})
+		m.Close()
+	}
+}
+
+// handoffTo passes the active listeners to a connected process. The
+// current process starts to shutdown after the process accepted them.
+func (a *App) handoffTo(m *StreamMessenger, e *Registry, info GenerationInfo, sameNS bool) error {
+	files, names := a.handoffFiles(e)
+	// There is no LISTEN_FDS here, so the pid lock travels with the
+	// listeners.
+	a.mutex.Lock()
+	if a.pidLock != nil {
+		files = append(files, a.pidLock)
+		names = append(names, pidLockFDName)
+	}
+	a.mutex.Unlock()
+	err := m.SendFiles(rendezvousMsg{Names: names, Generation: info}, files...)
+	if err != nil {
+		logger.Printf("failed to send listeners with: %v", err)
+		m.Close()
+		return err
+	}
+	// Pids mean nothing in another pid namespace.
+	drainingPIDs, shutdownPID := a.DrainingPIDs(), os.Getpid()
+	if !sameNS {
+		drainingPIDs, shutdownPID = nil, -1
+	}
+	return a.actAsParent(m, drainingPIDs, shutdownPID)
+}
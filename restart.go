@@ -0,0 +1,301 @@
+// Copyright 2017 Grigory Zubankov. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+//
+// +build linux darwin
+
+package zerodt
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// restartOp describes a restart in progress. Coalesced requests wait
+// for done and share the result.
+type restartOp struct {
+	done chan struct{}
+	err  error
+	// The number of requests waiting for done. Guarded by App.mutex.
+	waiters int
+}
+
+// SetRestartPolicy sets what to do with a restart requested while
+// another one is in progress.
+//
+// Default value is RestartCoalesce.
+func (a *App) SetRestartPolicy(p RestartPolicy) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.restartPolicy = p
+}
+
+// SetMinRestartInterval sets the minimum amount of time between the
+// starts of two restarts. Restarts requested sooner are rejected.
+//
+// Default value is 0 that means no limit.
+func (a *App) SetMinRestartInterval(d time.Duration) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.minRestartInterval = d
+}
+
+// State returns the current state of the app.
+func (a *App) State() State {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return a.state
+}
+
+// Restart starts a child to replace the current process, the same way
+// SIGUSR2 does. It returns as soon as the child has accepted the
+// listeners, the current process shuts down in background. It also
+// returns when the restart has failed or has been rejected.
+func (a *App) Restart() error {
+	return a.restart(RestartOptions{}, TriggerAPI)
+}
+
+// RestartWithOptions is like Restart but starts a process described by
+// opts, e.g. a new binary. A coalesced request joins the restart in
+// progress whatever options it has.
+func (a *App) RestartWithOptions(opts RestartOptions) error {
+	return a.restart(opts, TriggerAPI)
+}
+
+// RestartWithReason is like Restart but passes a reason to the new
+// process (see GenerationInfo).
+func (a *App) RestartWithReason(reason string) error {
+	return a.restart(RestartOptions{Reason: reason}, TriggerAPI)
+}
+
+// Generation returns the generation of the current process and the
+// restart that has started it.
+func (a *App) Generation() GenerationInfo {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return a.generationInfo
+}
+
+func (a *App) restart(opts RestartOptions, trigger RestartTrigger) error {
+	a.mutex.Lock()
+	masterPID := a.masterPID
+	supervisor := a.supervisor
+	a.mutex.Unlock()
+	if masterPID != 0 {
+		// Workers are replaced by the supervisor.
+		return a.forwardRestart(masterPID, opts, trigger)
+	}
+	return a.runRestart(trigger, opts.Reason, func(e *Registry, info GenerationInfo) (int, error) {
+		if supervisor {
+			return a.replaceWorkers(e, info, opts)
+		}
+		return a.handoff(e, info, opts)
+	})
+}
+
+// runRestart applies the restart policy and calls startFn to start a
+// successor. startFn returns a pid of the successor.
+func (a *App) runRestart(trigger RestartTrigger, reason string, startFn func(e *Registry, info GenerationInfo) (int, error)) error {
+	a.mutex.Lock()
+	for a.restartOp != nil {
+		op := a.restartOp
+		switch a.restartPolicy {
+		case RestartReject:
+			err := a.rejectRestart("another restart is in progress")
+			a.mutex.Unlock()
+			return err
+		case RestartQueue:
+			op.waiters++
+			a.mutex.Unlock()
+			<-op.done
+			a.mutex.Lock()
+		default:
+			op.waiters++
+			a.mutex.Unlock()
+			<-op.done
+			logger.Printf("restart request has been coalesced")
+			return op.err
+		}
+	}
+	if a.state != StateServing {
+		err := a.rejectRestart("app is not serving")
+		a.mutex.Unlock()
+		return err
+	}
+	if since := time.Since(a.lastRestart); since < a.minRestartInterval {
+		err := a.rejectRestart(fmt.Sprintf("the previous restart was %v ago, the minimum interval is %v", since, a.minRestartInterval))
+		a.mutex.Unlock()
+		return err
+	}
+	op := &restartOp{done: make(chan struct{})}
+	a.restartOp = op
+	a.lastRestart = time.Now()
+	a.setState(StateRestarting)
+	e := a.registry
+	info := GenerationInfo{
+		Generation: a.generation + 1,
+		ParentPID:  os.Getpid(),
+		Trigger:    trigger,
+		Reason:     reason,
+		Time:       a.lastRestart,
+	}
+	a.mutex.Unlock()
+
+	childPID, err := startFn(e, info)
+	op.err = err
+
+	a.mutex.Lock()
+	a.lastRestartResult = &RestartResult{Time: a.lastRestart, ChildPID: childPID, Generation: info.Generation, Trigger: trigger, Reason: reason}
+	if err != nil {
+		a.lastRestartResult.Error = err.Error()
+	}
+	// Shutdown changes the state in case of success.
+	if a.state == StateRestarting {
+		a.setState(StateServing)
+	}
+	a.restartOp = nil
+	close(op.done)
+	a.mutex.Unlock()
+
+	if op.err != nil {
+		logger.Printf("restart failed with: %v", op.err)
+	}
+	return op.err
+}
+
+// rejectRestart makes an error and keeps it as the result of the last
+// restart. It must be called with mutex held.
+func (a *App) rejectRestart(reason string) error {
+	err := &RestartRejectedError{a.state, reason}
+	logger.Printf("%v", err)
+	a.lastRestartResult = &RestartResult{Time: time.Now(), Error: err.Error()}
+	a.writeStatusFile()
+	return err
+}
+
+// handoff starts a child and passes the active listeners to it. The
+// current process starts to shutdown after the child accepted them.
+func (a *App) handoff(e *Registry, info GenerationInfo, opts RestartOptions) (int, error) {
+	files, names := a.handoffFiles(e)
+	env := []string{fmt.Sprintf("%s=%d", envGeneration, info.Generation), restartEnv(info)}
+	var extra []extraFile
+	a.mutex.Lock()
+	if a.pidLock != nil {
+		extra = append(extra, extraFile{envPIDLockFD, a.pidLock})
+	}
+	a.mutex.Unlock()
+	pid, f, err := a.forkExec(opts, files, names, extra, env)
+	if err != nil {
+		logger.Printf("failed to forkExec: %v", err)
+		return 0, err
+	}
+	m, err := ListenSocket(f)
+	if err != nil {
+		logger.Printf("failed to listen communication socket: %v", err)
+		return pid, err
+	}
+	return pid, a.actAsParent(m, a.DrainingPIDs(), os.Getpid())
+}
+
+// actAsParent passes the listeners to a child with the handshake. It
+// returns as soon as the child has accepted them. The current process
+// shuts down in background, the rest of the handshake goes along with
+// the shutdown.
+func (a *App) actAsParent(m *StreamMessenger, drainingPIDs []int, shutdownPID int) error {
+	accepted := make(chan struct{})
+	failed := make(chan error, 1)
+	a.handshakeWG.Add(1)
+	go func() {
+		defer a.handshakeWG.Done()
+		err := protocolActAsParent(a.handshakeCtx, m, a.waitChildTimeout, a.waitParentShutdownTimeout, drainingPIDs, shutdownPID, a.drainReport, func() {
+			a.handOver()
+			close(accepted)
+			a.Shutdown()
+		})
+		select {
+		case <-accepted:
+			// The restart is complete, errors are logged by the
+			// protocol.
+		default:
+			failed <- err
+		}
+	}()
+
+	select {
+	case <-accepted:
+		return nil
+	case err := <-failed:
+		return err
+	}
+}
+
+// handoffFiles returns listeners passed to a successor with their
+// names. Keys travel with the listeners as names.
+func (a *App) handoffFiles(e *Registry) ([]*os.File, []string) {
+	var files []*os.File
+	var names []string
+	for _, pr := range e.activeListeners() {
+		files = append(files, pr.f)
+		names = append(names, pr.name)
+	}
+	return files, names
+}
+
+// handOver makes a child the owner of the files that describe the
+// running generation. It is called by a parent when the child accepted
+// the listeners.
+func (a *App) handOver() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.owner = false
+	// The restart is complete, nothing can be restarted since now.
+	a.setState(StateDraining)
+	a.closeControlSocket()
+	a.closeRendezvousSocket()
+}
+
+// takeOver is called by a child when it accepts the listeners. The
+// child becomes the owner of the files that describe the running
+// generation unless it's a worker of a supervisor.
+func (a *App) takeOver(drainingPIDs []int, shutdownPID int) {
+	a.takeOverDraining(drainingPIDs, shutdownPID)
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.masterPID != 0 {
+		return
+	}
+	a.owner = true
+	a.writeStatusFile()
+	err := a.listenControlSocket()
+	if err != nil {
+		logger.Printf("failed to listen control socket with: %v", err)
+	}
+	err = a.listenRendezvousSocket()
+	if err != nil {
+		logger.Printf("failed to listen rendezvous socket with: %v", err)
+	}
+}
+
+// setState changes the state of the app. It must be called with
+// mutex held.
+func (a *App) setState(s State) {
+	if a.state == s {
+		return
+	}
+	logger.Printf("state changed: %v -> %v", a.state, s)
+	a.state = s
+	a.writeStatusFile()
+	// A child takes the pid file over once it's serving, so the pid
+	// file always names a generation that is able to serve.
+	if s == StateServing {
+		a.writePIDFile()
+	}
+}
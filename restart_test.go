@@ -0,0 +1,119 @@
+// Copyright 2017 Grigory Zubankov. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+//
+// +build linux darwin
+
+package zerodt
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestartNotServing(t *testing.T) {
+	a := NewApp()
+	assert.Equal(t, StateStarting, a.State())
+
+	err := a.Restart()
+	require.IsType(t, &RestartRejectedError{}, err)
+	assert.Equal(t, StateStarting, err.(*RestartRejectedError).State)
+	assert.Equal(t, "restart rejected while starting: app is not serving", err.Error())
+}
+
+func TestRestartMinInterval(t *testing.T) {
+	a := NewApp()
+	a.state = StateServing
+	a.lastRestart = time.Now()
+	a.SetMinRestartInterval(time.Hour)
+
+	err := a.Restart()
+	require.IsType(t, &RestartRejectedError{}, err)
+	assert.Regexp(t, "minimum interval is 1h0m0s$", err.Error())
+
+	// A rejection is kept as the result of the last restart.
+	r := a.Status().LastRestart
+	require.NotNil(t, r)
+	assert.Equal(t, err.Error(), r.Error)
+	assert.Equal(t, 0, r.ChildPID)
+}
+
+func TestRestartOverlapping(t *testing.T) {
+	a := NewApp()
+	a.state = StateServing
+
+	var calls int32
+	started := make(chan struct{})
+	release := make(chan error)
+	startFn := func(e *Registry, info GenerationInfo) (int, error) {
+		atomic.AddInt32(&calls, 1)
+		started <- struct{}{}
+		return 0, <-release
+	}
+	errCh := make(chan error)
+	restart := func() {
+		errCh <- a.runRestart(TriggerAPI, "", startFn)
+	}
+	// waitForWaiters waits until n requests wait for the restart in
+	// progress.
+	waitForWaiters := func(n int) {
+		for i := 0; ; i++ {
+			a.mutex.Lock()
+			waiters := a.restartOp.waiters
+			a.mutex.Unlock()
+			if waiters == n {
+				return
+			}
+			require.True(t, i < 500, "requests are not waiting")
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+
+	// Reject.
+	a.SetRestartPolicy(RestartReject)
+	go restart()
+	<-started
+	err := a.Restart()
+	require.IsType(t, &RestartRejectedError{}, err)
+	assert.Equal(t, StateRestarting, err.(*RestartRejectedError).State)
+	release <- nil
+	require.NoError(t, <-errCh)
+
+	// Coalesce. A request shares the result of the restart in progress.
+	a.SetRestartPolicy(RestartCoalesce)
+	go restart()
+	<-started
+	go restart()
+	waitForWaiters(1)
+	failed := errors.New("failed")
+	release <- failed
+	assert.Equal(t, failed, <-errCh)
+	assert.Equal(t, failed, <-errCh)
+	assert.EqualValues(t, 2, atomic.LoadInt32(&calls))
+
+	// Queue. A request starts another restart after the one in
+	// progress.
+	a.SetRestartPolicy(RestartQueue)
+	go restart()
+	<-started
+	go restart()
+	waitForWaiters(1)
+	release <- nil
+	require.NoError(t, <-errCh)
+	<-started
+	release <- failed
+	assert.Equal(t, failed, <-errCh)
+	assert.EqualValues(t, 4, atomic.LoadInt32(&calls))
+	assert.Equal(t, StateServing, a.State())
+}
+
+func TestStateString(t *testing.T) {
+	assert.Equal(t, "serving", StateServing.String())
+	assert.Equal(t, "stopped", StateStopped.String())
+	assert.Equal(t, "State(42)", State(42).String())
+}
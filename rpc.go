@@ -0,0 +1,412 @@
+// Copyright 2017 Grigory Zubankov. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+//
+// +build linux darwin
+
+package zerodt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Kinds of RPC messages.
+const (
+	rpcRequest = iota + 1
+	rpcReply
+	rpcEnd
+	rpcCancel
+)
+
+// ErrRPCClosed is returned by calls of a closed RPCConn.
+var ErrRPCClosed = errors.New("RPCConn: connection is closed")
+
+// rpcMsg is a frame of an RPC call. All frames of a call have the same
+// ID.
+type rpcMsg struct {
+	ID   uint64
+	Kind int
+	// Method is set for requests only.
+	Method  string
+	Payload []byte
+	// Error is set by a handler that failed. It is sent with rpcEnd.
+	Error string
+}
+
+// RPCError is returned by a call if the remote handler failed.
+type RPCError struct {
+	Method  string
+	Message string
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("rpc %s failed with: %s", e.Method, e.Message)
+}
+
+// RPCHandler handles a call. It sends any number of replies with w, a
+// non-streaming call expects exactly one. An error is passed to the
+// caller as RPCError. ctx is cancelled if the caller gave up or the
+// connection is closed.
+type RPCHandler func(ctx context.Context, req *RPCRequest, w *RPCReplyWriter) error
+
+// RPCRequest is an incoming call.
+type RPCRequest struct {
+	Method  string
+	payload []byte
+	codec   Codec
+}
+
+// Decode decodes arguments of a call to v.
+func (r *RPCRequest) Decode(v interface{}) error {
+	return r.codec.Unmarshal(r.payload, v)
+}
+
+// RPCReplyWriter sends replies to a call.
+type RPCReplyWriter struct {
+	c  *RPCConn
+	id uint64
+}
+
+// Send sends a reply.
+func (w *RPCReplyWriter) Send(v interface{}) error {
+	b, err := w.c.m.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return w.c.send(rpcMsg{ID: w.id, Kind: rpcReply, Payload: b})
+}
+
+// RPCConn is a request/response connection over a StreamMessenger.
+// Both ends may register handlers and make calls at the same time.
+// Calls are multiplexed by their IDs, so any number of them may be in
+// flight.
+//
+// Messages of a call are encoded by the codec of the messenger. The
+// messenger must not be used directly after the connection is
+// created.
+type RPCConn struct {
+	m         *StreamMessenger
+	sendMutex sync.Mutex
+
+	// Guarded by mutex.
+	mutex    sync.Mutex
+	handlers map[string]RPCHandler
+	calls    map[uint64]*rpcCall
+	served   map[uint64]context.CancelFunc
+	nextID   uint64
+	closed   bool
+	err      error
+}
+
+// NewRPCConn returns a connection on the given messenger. Serve must
+// be called to make calls and handle them.
+func NewRPCConn(m *StreamMessenger) *RPCConn {
+	return &RPCConn{
+		m:        m,
+		handlers: make(map[string]RPCHandler),
+		calls:    make(map[uint64]*rpcCall),
+		served:   make(map[uint64]context.CancelFunc),
+	}
+}
+
+// Handle registers a handler for a method. It replaces a handler
+// registered before.
+func (c *RPCConn) Handle(method string, h RPCHandler) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.handlers[method] = h
+}
+
+// Serve reads messages until the connection is closed. Handlers are
+// called in their own goroutines. It returns nil after Close.
+func (c *RPCConn) Serve() error {
+	for {
+		msg := rpcMsg{}
+		err := c.m.Recv(&msg)
+		if err != nil {
+			return c.fail(err)
+		}
+		switch msg.Kind {
+		case rpcRequest:
+			c.serve(msg)
+		case rpcReply, rpcEnd:
+			c.mutex.Lock()
+			call := c.calls[msg.ID]
+			if msg.Kind == rpcEnd {
+				delete(c.calls, msg.ID)
+			}
+			c.mutex.Unlock()
+			// A reply to a cancelled call is dropped.
+			if call != nil {
+				call.push(msg)
+			}
+		case rpcCancel:
+			c.mutex.Lock()
+			cancel := c.served[msg.ID]
+			c.mutex.Unlock()
+			if cancel != nil {
+				cancel()
+			}
+		default:
+			logger.Printf("RPCConn: unexpected message kind %d", msg.Kind)
+		}
+	}
+}
+
+// Close closes the connection. Calls in flight fail with ErrRPCClosed,
+// contexts of handlers are cancelled.
+func (c *RPCConn) Close() error {
+	c.mutex.Lock()
+	c.closed = true
+	c.mutex.Unlock()
+
+	err := c.m.Close()
+	c.fail(ErrRPCClosed)
+	return err
+}
+
+// Call calls a method and decodes the only reply to reply. The call is
+// cancelled on the remote side when ctx is done.
+func (c *RPCConn) Call(ctx context.Context, method string, args interface{}, reply interface{}) error {
+	s, err := c.Stream(ctx, method, args)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	err = s.Recv(reply)
+	if err == io.EOF {
+		return fmt.Errorf("rpc %s: no reply", method)
+	}
+	if err != nil {
+		return err
+	}
+	// The end of the call brings a handler's error if any.
+	err = s.Recv(nil)
+	if err == nil {
+		return fmt.Errorf("rpc %s: more than one reply", method)
+	}
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// Stream calls a method with streaming replies. The call is cancelled
+// on the remote side when ctx is done or the stream is closed.
+func (c *RPCConn) Stream(ctx context.Context, method string, args interface{}) (*RPCStream, error) {
+	b, err := c.m.codec.Marshal(args)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	if c.closed || c.err != nil {
+		c.mutex.Unlock()
+		return nil, ErrRPCClosed
+	}
+	c.nextID++
+	call := &rpcCall{notify: make(chan struct{}, 1)}
+	id := c.nextID
+	c.calls[id] = call
+	c.mutex.Unlock()
+
+	err = c.send(rpcMsg{ID: id, Kind: rpcRequest, Method: method, Payload: b})
+	if err != nil {
+		c.forget(id)
+		return nil, err
+	}
+	return &RPCStream{c: c, ctx: ctx, id: id, method: method, call: call}, nil
+}
+
+func (c *RPCConn) serve(msg rpcMsg) {
+	c.mutex.Lock()
+	h := c.handlers[msg.Method]
+	ctx, cancel := context.WithCancel(context.Background())
+	c.served[msg.ID] = cancel
+	if c.err != nil {
+		cancel()
+	}
+	c.mutex.Unlock()
+
+	go func() {
+		defer func() {
+			c.mutex.Lock()
+			delete(c.served, msg.ID)
+			c.mutex.Unlock()
+			cancel()
+		}()
+
+		var err error
+		if h == nil {
+			err = fmt.Errorf("unknown method %q", msg.Method)
+		} else {
+			err = h(ctx, &RPCRequest{msg.Method, msg.Payload, c.m.codec}, &RPCReplyWriter{c, msg.ID})
+		}
+		end := rpcMsg{ID: msg.ID, Kind: rpcEnd}
+		if err != nil {
+			end.Error = err.Error()
+		}
+		err = c.send(end)
+		if err != nil {
+			logger.Printf("RPCConn: failed to reply to %s with: %v", msg.Method, err)
+		}
+	}()
+}
+
+func (c *RPCConn) send(msg rpcMsg) error {
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+
+	return c.m.Send(msg)
+}
+
+// forget drops a call. The remote side is asked to cancel it if it is
+// not complete.
+func (c *RPCConn) forget(id uint64) {
+	c.mutex.Lock()
+	_, ok := c.calls[id]
+	delete(c.calls, id)
+	alive := !c.closed && c.err == nil
+	c.mutex.Unlock()
+	if ok && alive {
+		c.send(rpcMsg{ID: id, Kind: rpcCancel})
+	}
+}
+
+// fail completes all calls and handlers with err. It returns nil if the
+// connection has been closed by Close.
+func (c *RPCConn) fail(err error) error {
+	c.mutex.Lock()
+	if c.closed {
+		err = ErrRPCClosed
+	}
+	if c.err == nil {
+		c.err = err
+	}
+	calls, served := c.calls, c.served
+	c.calls = make(map[uint64]*rpcCall)
+	c.served = make(map[uint64]context.CancelFunc)
+	closed := c.closed
+	c.mutex.Unlock()
+
+	for _, call := range calls {
+		call.abort(err)
+	}
+	for _, cancel := range served {
+		cancel()
+	}
+	if closed {
+		return nil
+	}
+	return err
+}
+
+// rpcCall queues replies of a call. The queue is not limited, so a slow
+// reader does not block other calls.
+type rpcCall struct {
+	mutex   sync.Mutex
+	replies []rpcMsg
+	err     error
+	notify  chan struct{}
+}
+
+func (call *rpcCall) push(msg rpcMsg) {
+	call.mutex.Lock()
+	call.replies = append(call.replies, msg)
+	call.mutex.Unlock()
+	call.wake()
+}
+
+func (call *rpcCall) abort(err error) {
+	call.mutex.Lock()
+	call.err = err
+	call.mutex.Unlock()
+	call.wake()
+}
+
+func (call *rpcCall) wake() {
+	select {
+	case call.notify <- struct{}{}:
+	default:
+	}
+}
+
+// next returns the next reply or an error if the connection failed.
+func (call *rpcCall) next(ctx context.Context) (rpcMsg, error) {
+	for {
+		call.mutex.Lock()
+		if len(call.replies) > 0 {
+			msg := call.replies[0]
+			call.replies = call.replies[1:]
+			call.mutex.Unlock()
+			return msg, nil
+		}
+		err := call.err
+		call.mutex.Unlock()
+		if err != nil {
+			return rpcMsg{}, err
+		}
+		select {
+		case <-call.notify:
+		case <-ctx.Done():
+			return rpcMsg{}, ctx.Err()
+		}
+	}
+}
+
+// RPCStream receives replies of a call.
+type RPCStream struct {
+	c      *RPCConn
+	ctx    context.Context
+	id     uint64
+	method string
+	call   *rpcCall
+	done   bool
+	err    error
+}
+
+// Recv decodes the next reply to v. It returns io.EOF after the last
+// reply or RPCError if the handler failed.
+func (s *RPCStream) Recv(v interface{}) error {
+	if s.done {
+		return s.err
+	}
+	msg, err := s.call.next(s.ctx)
+	if err != nil {
+		s.finish(err)
+		s.c.forget(s.id)
+		return err
+	}
+	switch {
+	case msg.Kind == rpcEnd && msg.Error != "":
+		s.finish(&RPCError{s.method, msg.Error})
+		return s.err
+	case msg.Kind == rpcEnd:
+		s.finish(io.EOF)
+		return s.err
+	}
+	if v == nil {
+		return nil
+	}
+	return s.c.m.codec.Unmarshal(msg.Payload, v)
+}
+
+// Close cancels the call if it is not complete.
+func (s *RPCStream) Close() error {
+	if !s.done {
+		s.finish(io.EOF)
+		s.c.forget(s.id)
+	}
+	return nil
+}
+
+func (s *RPCStream) finish(err error) {
+	s.done = true
+	s.err = err
+}
@@ -0,0 +1,131 @@
+// Copyright 2017 Grigory Zubankov. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+//
+// +build linux darwin
+
+package zerodt
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newRPCPair(t *testing.T) (*RPCConn, *RPCConn) {
+	m0, m1 := newMessengerPair(t)
+	c0, c1 := NewRPCConn(m0), NewRPCConn(m1)
+	go c0.Serve()
+	go c1.Serve()
+	return c0, c1
+}
+
+func TestRPCCall(t *testing.T) {
+	c0, c1 := newRPCPair(t)
+	defer c0.Close()
+	defer c1.Close()
+
+	c1.Handle("draining", func(ctx context.Context, req *RPCRequest, w *RPCReplyWriter) error {
+		var pid int
+		if err := req.Decode(&pid); err != nil {
+			return err
+		}
+		return w.Send(pid * 10)
+	})
+	c0.Handle("fail", func(ctx context.Context, req *RPCRequest, w *RPCReplyWriter) error {
+		return errors.New("no way")
+	})
+
+	// Concurrent calls are matched with their replies.
+	var wg sync.WaitGroup
+	for i := 1; i <= 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var n int
+			assert.NoError(t, c0.Call(context.Background(), "draining", i, &n))
+			assert.Equal(t, i*10, n)
+		}(i)
+	}
+	wg.Wait()
+
+	// Both ends may call.
+	var n int
+	err := c1.Call(context.Background(), "fail", nil, &n)
+	require.IsType(t, &RPCError{}, err)
+	assert.Equal(t, "no way", err.(*RPCError).Message)
+
+	err = c1.Call(context.Background(), "unknown", nil, &n)
+	require.IsType(t, &RPCError{}, err)
+	assert.Contains(t, err.Error(), "unknown method")
+}
+
+func TestRPCStream(t *testing.T) {
+	c0, c1 := newRPCPair(t)
+	defer c0.Close()
+	defer c1.Close()
+
+	c1.Handle("count", func(ctx context.Context, req *RPCRequest, w *RPCReplyWriter) error {
+		var n int
+		if err := req.Decode(&n); err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			if err := w.Send(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	s, err := c0.Stream(context.Background(), "count", 3)
+	require.NoError(t, err)
+	defer s.Close()
+	var got []int
+	for {
+		var i int
+		err := s.Recv(&i)
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		got = append(got, i)
+	}
+	assert.Equal(t, []int{0, 1, 2}, got)
+}
+
+func TestRPCCancel(t *testing.T) {
+	c0, c1 := newRPCPair(t)
+	defer c1.Close()
+
+	cancelled := make(chan struct{})
+	c1.Handle("wait", func(ctx context.Context, req *RPCRequest, w *RPCReplyWriter) error {
+		<-ctx.Done()
+		close(cancelled)
+		return ctx.Err()
+	})
+
+	// A caller gives up, the handler is cancelled.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, c0.Call(ctx, "wait", nil, nil))
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second * 5):
+		t.Fatal("the handler is not cancelled")
+	}
+
+	// Calls in flight fail when the connection is closed.
+	s, err := c0.Stream(context.Background(), "wait", nil)
+	require.NoError(t, err)
+	require.NoError(t, c0.Close())
+	assert.Equal(t, ErrRPCClosed, s.Recv(nil))
+	_, err = c0.Stream(context.Background(), "wait", nil)
+	assert.Equal(t, ErrRPCClosed, err)
+}
@@ -0,0 +1,190 @@
+// Copyright 2017 Grigory Zubankov. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+//
+// +build linux darwin
+
+package zerodt
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+)
+
+const (
+	// The maximum number of files passed with a message (SCM_MAX_FD).
+	maxFilesPerMessage = 253
+)
+
+// UnexpectedFilesError is returned by Recv if a message has files.
+// The files are closed, use RecvFiles to receive them. The stream is
+// not broken.
+type UnexpectedFilesError struct {
+}
+
+func (e *UnexpectedFilesError) Error() string {
+	return "StreamMessenger: the message has files, use RecvFiles"
+}
+
+// SendFiles sends a message with files as SCM_RIGHTS ancillary data.
+// A receiver gets duplicates of the files, the caller still owns them.
+// The messenger must be based on a unix socket.
+func (m *StreamMessenger) SendFiles(v interface{}, files ...*os.File) error {
+	if len(files) == 0 {
+		return m.Send(v)
+	}
+	if len(files) > maxFilesPerMessage {
+		return fmt.Errorf("StreamMessenger: %d files exceed %d", len(files), maxFilesPerMessage)
+	}
+	uc, ok := m.c.(*net.UnixConn)
+	if !ok {
+		return errors.New("StreamMessenger: files require a unix socket")
+	}
+	b, err := m.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	frame, err := m.frame(messageTypeOf(v), flagFiles, b)
+	if err != nil {
+		return err
+	}
+	fds := make([]int, len(files))
+	for i, f := range files {
+		fds[i], err = fileFD(f)
+		if err != nil {
+			return err
+		}
+	}
+	n, _, err := uc.WriteMsgUnix(frame, syscall.UnixRights(fds...), nil)
+	if err != nil {
+		return err
+	}
+	_, err = uc.Write(frame[n:])
+	return err
+}
+
+// RecvFiles receives a message and files sent by SendFiles. It's
+// the caller's responsibility to close the files. A message without
+// files is received as well.
+func (m *StreamMessenger) RecvFiles(v interface{}) ([]*os.File, error) {
+	var files []*os.File
+	b, err := m.recv(messageTypeOf(v), &files)
+	if err == nil {
+		err = m.codec.Unmarshal(b, v)
+	}
+	if err != nil {
+		closeFiles(files)
+		return nil, err
+	}
+	return files, nil
+}
+
+// SendListeners sends a message with listeners. The listeners must
+// be TCP or unix ones.
+func (m *StreamMessenger) SendListeners(v interface{}, ls ...net.Listener) error {
+	var files []*os.File
+	defer func() { closeFiles(files) }()
+	for _, l := range ls {
+		fl, ok := l.(interface {
+			File() (*os.File, error)
+		})
+		if !ok {
+			return fmt.Errorf("StreamMessenger: can't send %T", l)
+		}
+		f, err := fl.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+	return m.SendFiles(v, files...)
+}
+
+// RecvListeners receives a message and listeners sent by SendListeners.
+func (m *StreamMessenger) RecvListeners(v interface{}) ([]net.Listener, error) {
+	files, err := m.RecvFiles(v)
+	if err != nil {
+		return nil, err
+	}
+	defer closeFiles(files)
+	var ls []net.Listener
+	for _, f := range files {
+		l, err := net.FileListener(f)
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return nil, err
+		}
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
+
+// readFiles reads the beginning of a frame to b with files passed with
+// it.
+func (m *StreamMessenger) readFiles(b []byte, files *[]*os.File) (int, error) {
+	uc, ok := m.c.(*net.UnixConn)
+	if !ok {
+		return 0, errors.New("StreamMessenger: files require a unix socket")
+	}
+	rc, err := uc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	// ReadMsgUnix does not allow to pass flags, so the descriptors
+	// could leak to a process started by another goroutine before they
+	// are marked close-on-exec.
+	oob := make([]byte, syscall.CmsgSpace(maxFilesPerMessage*4))
+	var n, oobn, flags int
+	var rerr error
+	err = rc.Read(func(fd uintptr) bool {
+		for {
+			n, oobn, flags, _, rerr = syscall.Recvmsg(int(fd), b, oob, recvmsgFlags)
+			if rerr != syscall.EINTR {
+				break
+			}
+		}
+		// Wait for the socket to become readable.
+		return rerr != syscall.EAGAIN
+	})
+	if err == nil {
+		err = rerr
+	}
+	if err != nil {
+		return n, err
+	}
+	if n == 0 && oobn == 0 {
+		return n, io.EOF
+	}
+	cmsgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return n, err
+	}
+	for _, cmsg := range cmsgs {
+		fds, err := syscall.ParseUnixRights(&cmsg)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			if recvmsgFlags == 0 {
+				syscall.CloseOnExec(fd)
+			}
+			*files = append(*files, os.NewFile(uintptr(fd), fmt.Sprintf("scm-rights|%d", fd)))
+		}
+	}
+	if flags&syscall.MSG_CTRUNC != 0 {
+		return n, errors.New("StreamMessenger: files are truncated")
+	}
+	return n, nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
@@ -0,0 +1,11 @@
+// Copyright 2017 Grigory Zubankov. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+//
+// +build darwin
+
+package zerodt
+
+// recvmsgFlags is empty since there is no MSG_CMSG_CLOEXEC on darwin.
+// Received file descriptors are marked close-on-exec after recvmsg.
+const recvmsgFlags = 0
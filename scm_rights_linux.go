@@ -0,0 +1,15 @@
+// Copyright 2017 Grigory Zubankov. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+//
+// +build linux
+
+package zerodt
+
+import (
+	"syscall"
+)
+
+// recvmsgFlags makes received file descriptors close-on-exec
+// atomically.
+const recvmsgFlags = syscall.MSG_CMSG_CLOEXEC
@@ -0,0 +1,218 @@
+// Copyright 2017 Grigory Zubankov. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+//
+
+package zerodt
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// State describes a state of an App.
+type State int
+
+const (
+	// StateStarting means servers are about to start serving.
+	StateStarting State = iota
+	// StateServing means all servers are serving.
+	StateServing
+	// StateRestarting means a child is being started to replace
+	// the current process.
+	StateRestarting
+	// StateDraining means servers are shutting down without
+	// interrupting any active connections.
+	StateDraining
+	// StateStopped means all servers have been shutdown.
+	StateStopped
+)
+
+var stateNames = []string{"starting", "serving", "restarting", "draining", "stopped"}
+
+func (s State) String() string {
+	if s < 0 || int(s) >= len(stateNames) {
+		return fmt.Sprintf("State(%d)", int(s))
+	}
+	return stateNames[s]
+}
+
+// RestartPolicy describes what to do with a restart requested while
+// another one is in progress.
+type RestartPolicy int
+
+const (
+	// RestartCoalesce joins the restart in progress and returns its
+	// result. It is the default policy.
+	RestartCoalesce RestartPolicy = iota
+	// RestartReject rejects a restart immediately.
+	RestartReject
+	// RestartQueue waits for the restart in progress to finish and
+	// starts another one if the app is still serving.
+	RestartQueue
+)
+
+// RestartRejectedError is returned if a restart was not started.
+type RestartRejectedError struct {
+	// State is the state of an App when a restart was requested.
+	State State
+	// Reason describes why a restart was rejected.
+	Reason string
+}
+
+func (e *RestartRejectedError) Error() string {
+	return fmt.Sprintf("restart rejected while %v: %s", e.State, e.Reason)
+}
+
+// ProtocolError is returned by a restart if a parent and a child can't
+// agree on the handshake protocol, e.g. after an upgrade of zerodt.
+type ProtocolError struct {
+	// Reason describes the incompatibility.
+	Reason string
+}
+
+func (e *ProtocolError) Error() string {
+	return "incompatible handshake protocol: " + e.Reason
+}
+
+// DrainProgress describes connections of a generation that is shutting
+// down.
+type DrainProgress struct {
+	// OpenConnections is the number of connections that are not closed
+	// yet.
+	OpenConnections int
+	// InFlightRequests is the number of connections that are handling
+	// a request.
+	InFlightRequests int
+}
+
+// ServerDrainReport describes connections of a server that is shutting
+// down.
+type ServerDrainReport struct {
+	Listener string
+	DrainProgress
+	// OldestRequestAge is 0 if there are no requests in flight.
+	OldestRequestAge time.Duration
+}
+
+// DrainReport describes a generation that is shutting down. Totals of
+// all servers are in DrainProgress and OldestRequestAge.
+type DrainReport struct {
+	PID int
+	// Elapsed is the time since the shutdown started.
+	Elapsed time.Duration
+	DrainProgress
+	OldestRequestAge time.Duration
+	Servers          []ServerDrainReport
+}
+
+// EscalationPolicy describes how to stop a draining generation early.
+// A zero policy kills a generation with SIGKILL immediately.
+type EscalationPolicy struct {
+	// Signal is sent to a generation first, e.g. SIGQUIT to get a
+	// goroutine dump of a generation that is stuck. SIGKILL is sent if
+	// a generation is still alive after Timeout.
+	Signal  os.Signal
+	Timeout time.Duration
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (s *State) UnmarshalText(text []byte) error {
+	for i, name := range stateNames {
+		if name == string(text) {
+			*s = State(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown state: %s", text)
+}
+
+// Status describes the running generation of an App.
+type Status struct {
+	PID int
+	// Generation is 1 for the first process and is incremented on
+	// every restart.
+	Generation   int
+	StartTime    time.Time
+	State        State
+	Listeners    []ListenerStatus
+	DrainingPIDs []int
+	// LastRestart is nil if there were no restarts.
+	LastRestart *RestartResult
+	// WorkerCrashes is the number of crashed workers of a supervisor.
+	WorkerCrashes int
+	// Workers is nil if the app is not a supervisor.
+	Workers []WorkerStatus
+}
+
+// WorkerStatus describes a worker of a supervisor.
+type WorkerStatus struct {
+	Slot int
+	// PID is 0 if a worker of the slot is being respawned.
+	PID        int
+	Generation int
+	StartTime  time.Time
+	// State is StateStarting until a worker accepts the listeners
+	// and StateRestarting while a worker is being respawned.
+	State State
+	// Restarts is the number of workers that replaced the previous
+	// ones of the slot.
+	Restarts int
+	Crashes  int
+}
+
+// ListenerStatus describes a listener of a server.
+type ListenerStatus struct {
+	Key string
+	// Addr is empty if a server is not listening.
+	Addr string
+}
+
+// RestartResult describes the result of a restart.
+type RestartResult struct {
+	Time     time.Time
+	ChildPID int
+	// Generation is the generation of the started process.
+	Generation int
+	// Trigger and Reason describe what has requested a restart.
+	Trigger RestartTrigger
+	Reason  string
+	// Error is empty if a restart succeeded.
+	Error string
+}
+
+// RestartOptions describes a process to start on restart.
+type RestartOptions struct {
+	// Path is a path to a binary. The current executable is used if
+	// it is empty. A relative path is resolved against the original
+	// working directory.
+	Path string
+	// Args are command-line arguments without the program name. The
+	// current arguments are used if Args is nil.
+	Args []string
+	// Reason is passed to the new process as a part of GenerationInfo.
+	Reason string
+}
+
+// CrashRestartPolicy describes how a supervisor respawns a worker that
+// exited unexpectedly.
+type CrashRestartPolicy struct {
+	// InitialBackoff is a delay before respawning a worker after the
+	// first crash. It doubles with every crash within CrashWindow up
+	// to MaxBackoff. 0 means no cap.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// MaxCrashes is the number of crashes within CrashWindow that is
+	// considered a crash loop. The supervisor stops in this case. The
+	// value of 1 disables respawning, 0 means no limit.
+	MaxCrashes int
+	// CrashWindow is the period crashes are counted in. 0 means
+	// crashes are never forgotten.
+	CrashWindow time.Duration
+}
@@ -0,0 +1,163 @@
+// Copyright 2017 Grigory Zubankov. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+//
+// +build linux darwin
+
+package zerodt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	// A generation number passed to a child.
+	envGeneration = "ZERODT_GENERATION"
+)
+
+// SetStatusFile sets a path to a JSON file that describes the running
+// generation. The file is atomically rewritten on every state change.
+// A child takes the file over when it accepts the listeners.
+//
+// Default value is empty that means no status file.
+func (a *App) SetStatusFile(path string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.statusFile = path
+}
+
+// Status returns the current status of the app.
+func (a *App) Status() Status {
+	// Draining generations are checked without mutex held.
+	pids := a.DrainingPIDs()
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	st := a.statusLocked()
+	st.DrainingPIDs = pids
+	return st
+}
+
+// statusLocked makes a status without draining generations. It must be
+// called with mutex held.
+func (a *App) statusLocked() Status {
+	st := Status{
+		PID:           os.Getpid(),
+		Generation:    a.generation,
+		StartTime:     a.startTime,
+		State:         a.state,
+		LastRestart:   a.lastRestartResult,
+		WorkerCrashes: a.crashCount,
+		Workers:       a.workersStatus(),
+	}
+	for _, as := range a.servers {
+		ls := ListenerStatus{Key: as.key}
+		if as.l != nil {
+			ls.Addr = as.l.Addr().String()
+		}
+		st.Listeners = append(st.Listeners, ls)
+	}
+	return st
+}
+
+// writeStatusFile writes the current status to the status file if the
+// current process owns it. The file is written in background, so the
+// mutex is not held during file I/O. It must be called with mutex held.
+func (a *App) writeStatusFile() {
+	if a.statusFile == "" || !a.owner {
+		return
+	}
+	a.statusPending = true
+	if a.statusDone != nil {
+		// The writer picks the change up.
+		return
+	}
+	a.statusDone = make(chan struct{})
+	go a.statusWriter(a.statusDone)
+}
+
+// statusWriter writes the status file until there are no changes.
+func (a *App) statusWriter(done chan struct{}) {
+	defer close(done)
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for a.statusPending && a.statusFile != "" && a.owner {
+		a.statusPending = false
+		path := a.statusFile
+		st := a.statusLocked()
+		a.mutex.Unlock()
+
+		st.DrainingPIDs = a.DrainingPIDs()
+		b, err := json.MarshalIndent(st, "", "  ")
+		if err == nil {
+			err = writeFileAtomic(path, append(b, '\n'), 0644)
+		}
+		if err != nil {
+			logger.Printf("failed to write status file with: %v", err)
+		}
+
+		a.mutex.Lock()
+	}
+	a.statusPending = false
+	a.statusDone = nil
+}
+
+// syncStatusFile waits until the status file is written.
+func (a *App) syncStatusFile() {
+	a.mutex.Lock()
+	done := a.statusDone
+	a.mutex.Unlock()
+
+	if done != nil {
+		<-done
+	}
+}
+
+// initGeneration reads the generation passed by a parent. A child
+// knows the restart that has started it. It must be called with mutex
+// held.
+func (a *App) initGeneration() {
+	a.generation = generationFromEnv()
+	a.startTime = time.Now()
+	a.generationInfo = generationInfoFromEnv(a.generation, a.startTime)
+	if info := a.generationInfo; info.Trigger != "" {
+		a.lastRestartResult = &RestartResult{Time: info.Time, ChildPID: os.Getpid(), Generation: a.generation, Trigger: info.Trigger, Reason: info.Reason}
+	}
+}
+
+// generationFromEnv returns a generation number passed by a parent
+// or 1 for the first process.
+func generationFromEnv() int {
+	defer os.Unsetenv(envGeneration)
+	generation, err := strconv.Atoi(os.Getenv(envGeneration))
+	if err != nil || generation < 1 {
+		return 1
+	}
+	return generation
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory
+// and renames it. Readers see either the old or the new content.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := filepath.Join(filepath.Dir(path), fmt.Sprintf(".%s.%d.tmp", filepath.Base(path), os.Getpid()))
+	err := ioutil.WriteFile(tmp, data, perm)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
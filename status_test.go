@@ -0,0 +1,66 @@
+// Copyright 2017 Grigory Zubankov. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+//
+// +build linux darwin
+
+package zerodt
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteStatusFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zerodt-status-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "status.json")
+
+	a := NewApp(&http.Server{Addr: ":8080"})
+	a.SetStatusFile(path)
+	a.generation = 3
+
+	// Not an owner.
+	a.mutex.Lock()
+	a.setState(StateServing)
+	a.mutex.Unlock()
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	a.takeOver(nil, os.Getppid())
+	a.mutex.Lock()
+	a.setState(StateDraining)
+	a.mutex.Unlock()
+	a.syncStatusFile()
+
+	b, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(b), `"State": "draining"`)
+	st := Status{}
+	require.NoError(t, json.Unmarshal(b, &st))
+	assert.Equal(t, os.Getpid(), st.PID)
+	assert.Equal(t, 3, st.Generation)
+	assert.Equal(t, StateDraining, st.State)
+	assert.Equal(t, []ListenerStatus{{Key: ":8080"}}, st.Listeners)
+	assert.Equal(t, []int{os.Getppid()}, st.DrainingPIDs)
+
+	// No temporary files left.
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(files))
+}
+
+func TestGenerationFromEnv(t *testing.T) {
+	os.Setenv(envGeneration, "5")
+	assert.Equal(t, 5, generationFromEnv())
+	assert.Equal(t, "", os.Getenv(envGeneration))
+	assert.Equal(t, 1, generationFromEnv())
+}
@@ -7,9 +7,11 @@
 package zerodt
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
-	"encoding/json"
-	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"net"
 	"os"
@@ -26,16 +28,30 @@ import (
 //	m0, err := ListenSocket(f0)
 //	m1, err := ListenSocket(f1)
 //
+// Messages are encoded by a codec (see SetCodec). The codec is recorded
+// in the header, so a message encoded by another codec is rejected.
 //
-// Packet format:
-// +-----------------------+---------+
-// |   Header (8 bytes)    | Payload |
-// +-----------------------+---------+
-// | MagicN | Payload Size | Payload |
-// +-----------------------+---------+
+// v1 packet format:
+// +-------------------------------+---------+
+// |       Header (8 bytes)        | Payload |
+// +-------------------------------+---------+
+// | MagicN | Codec | Payload Size | Payload |
+// +-------------------------------+---------+
 //
+// v2 packet format:
+// +-------------------------------+--------------------------------+---------+
+// |       Header (8 bytes)        |      Extension (8 bytes)       | Payload |
+// +-------------------------------+--------------------------------+---------+
+// | MagicN | Codec | Payload Size | Version | Flags | Type | CRC32 | Payload |
+// +-------------------------------+--------------------------------+---------+
+//
+// Recv accepts both formats, Send uses the one set by SetFrameVersion.
+// Messages with files (see SendFiles) are always sent in v2 frames.
 type StreamMessenger struct {
-	c net.Conn
+	c            net.Conn
+	codec        Codec
+	frameVersion int
+	maxSize      int
 }
 
 // ListenSocket TODO
@@ -45,7 +61,38 @@ func ListenSocket(s *os.File) (*StreamMessenger, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &StreamMessenger{c}, nil
+	return NewStreamMessenger(c), nil
+}
+
+// NewStreamMessenger returns a messenger on the given connection,
+// e.g. on a connection to the control socket.
+func NewStreamMessenger(c net.Conn) *StreamMessenger {
+	return &StreamMessenger{c, JSONCodec, FrameV1, defaultMaxMessageSize}
+}
+
+// SetCodec sets a codec for messages. Both ends must use the same one.
+//
+// Default value is JSONCodec.
+func (m *StreamMessenger) SetCodec(c Codec) {
+	m.codec = c
+}
+
+// SetFrameVersion sets the format of sent messages. FrameV1 is
+// understood by messengers without v2 frames, so FrameV2 should be set
+// only when the peer is known to support it, e.g. after the handshake
+// has negotiated it.
+//
+// Default value is FrameV1.
+func (m *StreamMessenger) SetFrameVersion(v int) {
+	m.frameVersion = v
+}
+
+// SetMaxMessageSize sets the maximum size of a payload of sent and
+// received messages.
+//
+// Default value is 16MB.
+func (m *StreamMessenger) SetMaxMessageSize(n int) {
+	m.maxSize = n
 }
 
 // SetDeadline sets the read and write deadlines associated
@@ -83,32 +130,111 @@ func (m *StreamMessenger) SetWriteDeadline(t time.Time) error {
 	return m.c.SetWriteDeadline(t)
 }
 
-// Recv receives a message from the channel.
+// Recv receives a message from the channel. If v implements
+// TypedMessage, a message of another type is rejected with
+// UnexpectedMessageError.
 func (m *StreamMessenger) Recv(v interface{}) (err error) {
-	b, err := m.recv()
+	b, err := m.recv(messageTypeOf(v), nil)
 	if err != nil {
 		return err
 	}
-	return json.Unmarshal(b, v)
+	return m.codec.Unmarshal(b, v)
 }
 
-// Send sends a message to the channel.
+// Send sends a message to the channel. If v implements TypedMessage,
+// its type is recorded in a v2 frame.
 func (m *StreamMessenger) Send(v interface{}) error {
-	b, err := json.Marshal(v)
+	b, err := m.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	frame, err := m.frame(messageTypeOf(v), 0, b)
 	if err != nil {
 		return err
 	}
-	return m.send(b)
+	_, err = m.c.Write(frame)
+	return err
 }
 
-func (m *StreamMessenger) recv() ([]byte, error) {
-	h := header{}
-	err := binary.Read(m.c, binary.LittleEndian, &h)
+// RecvContext is like Recv but unblocks when ctx is done. The deadline
+// of ctx is used as the deadline of the connection. The stream is
+// broken if a message is interrupted.
+func (m *StreamMessenger) RecvContext(ctx context.Context, v interface{}) error {
+	return m.withContext(ctx, func() error {
+		return m.Recv(v)
+	})
+}
+
+// SendContext is like Send but unblocks when ctx is done. The deadline
+// of ctx is used as the deadline of the connection. The stream is
+// broken if a message is interrupted.
+func (m *StreamMessenger) SendContext(ctx context.Context, v interface{}) error {
+	return m.withContext(ctx, func() error {
+		return m.Send(v)
+	})
+}
+
+// withContext calls fn with the deadline of ctx and interrupts it when
+// ctx is done. It returns the error of ctx in this case.
+func (m *StreamMessenger) withContext(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	m.c.SetDeadline(deadline)
+	defer m.c.SetDeadline(time.Time{})
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			// A deadline in the past unblocks pending I/O.
+			m.c.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	err := fn()
+	close(stop)
+	<-stopped
+	if err == nil {
+		return nil
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	// The connection may time out a bit earlier than ctx is done.
+	if ne, ok := err.(net.Error); ok && ne.Timeout() && !deadline.IsZero() {
+		return context.DeadlineExceeded
+	}
+	return err
+}
+
+// recv reads a frame. Files passed with the frame are stored to files.
+// A frame with files is rejected if files is nil.
+func (m *StreamMessenger) recv(typ uint16, files *[]*os.File) ([]byte, error) {
+	h, err := m.readHeader(files)
 	if err != nil {
 		return nil, err
 	}
-	if !isValidHeader(h) {
-		return nil, errors.New("StreamMessenger: the header is invalid")
+	ext := headerExt{}
+	switch h.Prefix & headerPrefixMask {
+	case headerPrefix:
+	case headerPrefixV2:
+		err = binary.Read(m.c, binary.LittleEndian, &ext)
+		if err != nil {
+			return nil, err
+		}
+		if ext.Version != FrameV2 || ext.Flags&^flagFiles != 0 {
+			return nil, &CorruptedFrameError{fmt.Sprintf("unsupported frame version %d with flags %#x", ext.Version, ext.Flags)}
+		}
+	default:
+		return nil, &CorruptedFrameError{"the header is invalid"}
+	}
+	// The stream is broken, there is no way to skip a message.
+	if int64(h.Size) > int64(m.maxSize) {
+		return nil, &MessageTooLargeError{int(h.Size), m.maxSize}
 	}
 	// Read the whole message to avoid breaking the stream.
 	rs := make([]byte, h.Size)
@@ -116,19 +242,60 @@ func (m *StreamMessenger) recv() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	if ext.Version == FrameV2 && crc32.ChecksumIEEE(rs) != ext.CRC {
+		return nil, &CorruptedFrameError{"the checksum does not match"}
+	}
+	if ext.Flags&flagFiles != 0 && files == nil {
+		// The kernel has already closed the files.
+		return nil, &UnexpectedFilesError{}
+	}
+	if ext.Flags&flagFiles != 0 && len(*files) == 0 {
+		return nil, &CorruptedFrameError{"the files of the message are lost"}
+	}
+	if h.codec() != m.codec.ID() {
+		return nil, fmt.Errorf("StreamMessenger: the message is encoded by codec %q, expected %q", h.codec(), m.codec.ID())
+	}
+	// v1 frames and untyped messages have no type.
+	if typ != 0 && ext.Type != 0 && ext.Type != typ {
+		return nil, &UnexpectedMessageError{typ, ext.Type}
+	}
 	return rs, nil
 }
 
-func (m *StreamMessenger) send(data []byte) error {
-	err := binary.Write(m.c, binary.LittleEndian, newHeader(len(data)))
+// readHeader reads the header of a frame. Files are received with the
+// first byte of the frame.
+func (m *StreamMessenger) readHeader(files *[]*os.File) (header, error) {
+	h := header{}
+	if files == nil {
+		return h, binary.Read(m.c, binary.LittleEndian, &h)
+	}
+	b := make([]byte, binary.Size(h))
+	n, err := m.readFiles(b, files)
 	if err != nil {
-		return err
+		return h, err
 	}
-	_, err = m.c.Write(data)
+	_, err = io.ReadFull(m.c, b[n:])
 	if err != nil {
-		return err
+		return h, err
+	}
+	return h, binary.Read(bytes.NewReader(b), binary.LittleEndian, &h)
+}
+
+// frame makes a frame of a message. Frames with flags are always v2.
+func (m *StreamMessenger) frame(typ uint16, flags uint8, data []byte) ([]byte, error) {
+	if len(data) > m.maxSize {
+		return nil, &MessageTooLargeError{len(data), m.maxSize}
+	}
+	// A frame is written at once.
+	var b bytes.Buffer
+	if m.frameVersion == FrameV1 && flags == 0 {
+		binary.Write(&b, binary.LittleEndian, newHeader(m.codec.ID(), len(data)))
+	} else {
+		binary.Write(&b, binary.LittleEndian, header{headerPrefixV2 | uint32(m.codec.ID()), uint32(len(data))})
+		binary.Write(&b, binary.LittleEndian, headerExt{FrameV2, flags, typ, crc32.ChecksumIEEE(data)})
 	}
-	return nil
+	b.Write(data)
+	return b.Bytes(), nil
 }
 
 // Close closes the connection.
@@ -137,8 +304,69 @@ func (m *StreamMessenger) Close() error {
 	return m.c.Close()
 }
 
+// TypedMessage is a message with a type ID. The type is sent with the
+// message in a v2 frame and checked by a receiver.
+type TypedMessage interface {
+	MessageType() uint16
+}
+
+func messageTypeOf(v interface{}) uint16 {
+	if tm, ok := v.(TypedMessage); ok {
+		return tm.MessageType()
+	}
+	return 0
+}
+
+// UnexpectedMessageError is returned by Recv if a message of another
+// type is received. The stream is not broken.
+type UnexpectedMessageError struct {
+	Expected uint16
+	Received uint16
+}
+
+func (e *UnexpectedMessageError) Error() string {
+	return fmt.Sprintf("StreamMessenger: unexpected message type %d, expected %d", e.Received, e.Expected)
+}
+
+// MessageTooLargeError is returned if a message exceeds the maximum
+// size. The stream is broken if it's returned by Recv.
+type MessageTooLargeError struct {
+	Size    int
+	MaxSize int
+}
+
+func (e *MessageTooLargeError) Error() string {
+	return fmt.Sprintf("StreamMessenger: message size %d exceeds %d", e.Size, e.MaxSize)
+}
+
+// CorruptedFrameError is returned by Recv if a frame is invalid.
+type CorruptedFrameError struct {
+	Reason string
+}
+
+func (e *CorruptedFrameError) Error() string {
+	return "StreamMessenger: " + e.Reason
+}
+
+// Frame versions.
+const (
+	// FrameV1 has a magic number, a codec and a size.
+	FrameV1 = 1
+	// FrameV2 also has a version, flags, a message type and a CRC32 of
+	// the payload.
+	FrameV2 = 2
+)
+
 const (
-	headerPrefix = uint32(0x5a45524f)
+	// The lowest byte of the prefix is an ID of a codec.
+	headerPrefix     = uint32(0x5a455200)
+	headerPrefixV2   = uint32(0x5a443200)
+	headerPrefixMask = uint32(0xffffff00)
+
+	// Files are passed with a frame.
+	flagFiles = uint8(0x1)
+
+	defaultMaxMessageSize = 16 << 20
 )
 
 type header struct {
@@ -146,10 +374,18 @@ type header struct {
 	Size   uint32
 }
 
-func newHeader(size int) header {
-	return header{headerPrefix, uint32(size)}
+// headerExt follows the header in a v2 frame.
+type headerExt struct {
+	Version uint8
+	Flags   uint8
+	Type    uint16
+	CRC     uint32
+}
+
+func newHeader(codec byte, size int) header {
+	return header{headerPrefix | uint32(codec), uint32(size)}
 }
 
-func isValidHeader(h header) bool {
-	return h.Prefix == headerPrefix
+func (h header) codec() byte {
+	return byte(h.Prefix)
 }
@@ -7,6 +7,9 @@
 package zerodt
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"net"
 	"os"
 	"sync"
@@ -176,3 +179,169 @@ func TestPipeJSONMessengerWithDeadlineFailWithRead(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestMessengerCodecs(t *testing.T) {
+	m0, m1 := newMessengerPair(t)
+	defer m0.Close()
+	defer m1.Close()
+
+	// JSON messages keep the 0.1 header.
+	assert.Equal(t, uint32(0x5a45524f), newHeader(JSONCodec.ID(), 0).Prefix)
+
+	type state struct {
+		Timeout time.Duration
+		Data    []byte
+	}
+	m0.SetCodec(GobCodec)
+	m1.SetCodec(GobCodec)
+	require.NoError(t, m0.Send(state{time.Second, []byte{1, 2, 3}}))
+	st := state{}
+	require.NoError(t, m1.Recv(&st))
+	assert.Equal(t, state{time.Second, []byte{1, 2, 3}}, st)
+
+	m0.SetCodec(RawCodec)
+	m1.SetCodec(RawCodec)
+	require.NoError(t, m0.Send([]byte("raw")))
+	var b []byte
+	require.NoError(t, m1.Recv(&b))
+	assert.Equal(t, "raw", string(b))
+	assert.Error(t, m0.Send(st))
+
+	// A mismatch is detected and the stream is not broken.
+	m1.SetCodec(JSONCodec)
+	require.NoError(t, m0.Send([]byte("raw")))
+	err := m1.Recv(&b)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "codec")
+	m0.SetCodec(JSONCodec)
+	require.NoError(t, m0.Send(state{Timeout: time.Minute}))
+	require.NoError(t, m1.Recv(&st))
+	assert.Equal(t, time.Minute, st.Timeout)
+}
+
+type typedTestMsg struct {
+	Int int
+}
+
+func (typedTestMsg) MessageType() uint16 { return 7 }
+
+func TestMessengerFrames(t *testing.T) {
+	m0, m1 := newMessengerPair(t)
+	defer m0.Close()
+	defer m1.Close()
+
+	// Old peers understand the default version.
+	assert.Equal(t, FrameV1, m0.frameVersion)
+
+	// Both versions are accepted.
+	require.NoError(t, m0.Send(typedTestMsg{1}))
+	m0.SetFrameVersion(FrameV2)
+	require.NoError(t, m0.Send(typedTestMsg{2}))
+	msg := typedTestMsg{}
+	require.NoError(t, m1.Recv(&msg))
+	assert.Equal(t, 1, msg.Int)
+	require.NoError(t, m1.Recv(&msg))
+	assert.Equal(t, 2, msg.Int)
+
+	// A message of another type.
+	require.NoError(t, m0.Send(readyMsg{}))
+	err := m1.Recv(&msg)
+	require.IsType(t, &UnexpectedMessageError{}, err)
+	assert.Equal(t, &UnexpectedMessageError{7, readyMsgType}, err)
+
+	// A corrupted payload.
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, header{headerPrefixV2 | uint32(JSONCodec.ID()), 2})
+	binary.Write(&b, binary.LittleEndian, headerExt{FrameV2, 0, 7, 0})
+	b.WriteString("{}")
+	_, err = m0.c.Write(b.Bytes())
+	require.NoError(t, err)
+	err = m1.Recv(&msg)
+	require.IsType(t, &CorruptedFrameError{}, err)
+
+	// Too large messages.
+	m0.SetMaxMessageSize(4)
+	require.IsType(t, &MessageTooLargeError{}, m0.Send(typedTestMsg{3}))
+	m0.SetMaxMessageSize(defaultMaxMessageSize)
+	m1.SetMaxMessageSize(4)
+	require.NoError(t, m0.Send(typedTestMsg{3}))
+	assert.Equal(t, &MessageTooLargeError{9, 4}, m1.Recv(&msg))
+}
+
+func TestMessengerFiles(t *testing.T) {
+	m0, m1 := newMessengerPair(t)
+	defer m0.Close()
+	defer m1.Close()
+
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	defer r.Close()
+	defer w.Close()
+	require.NoError(t, m0.SendFiles(typedTestMsg{1}, r))
+	msg := typedTestMsg{}
+	files, err := m1.RecvFiles(&msg)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	defer files[0].Close()
+	assert.Equal(t, 1, msg.Int)
+	// The received file is not passed to processes started later.
+	fdFlags, _, errno := syscall.Syscall(syscall.SYS_FCNTL, files[0].Fd(), syscall.F_GETFD, 0)
+	require.Zero(t, errno)
+	assert.NotZero(t, fdFlags&syscall.FD_CLOEXEC)
+	// The received file is a duplicate of the pipe.
+	_, err = w.Write([]byte("x"))
+	require.NoError(t, err)
+	b := make([]byte, 1)
+	_, err = files[0].Read(b)
+	require.NoError(t, err)
+	assert.Equal(t, "x", string(b))
+
+	// Recv rejects files and keeps the stream.
+	require.NoError(t, m0.SendFiles(typedTestMsg{2}, r))
+	require.IsType(t, &UnexpectedFilesError{}, m1.Recv(&msg))
+
+	// Listeners.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	require.NoError(t, m0.SendListeners(typedTestMsg{3}, l))
+	ls, err := m1.RecvListeners(&msg)
+	require.NoError(t, err)
+	require.Len(t, ls, 1)
+	defer ls[0].Close()
+	assert.Equal(t, 3, msg.Int)
+	assert.Equal(t, l.Addr().String(), ls[0].Addr().String())
+
+	// A message without files.
+	require.NoError(t, m0.Send(typedTestMsg{4}))
+	files, err = m1.RecvFiles(&msg)
+	require.NoError(t, err)
+	assert.Empty(t, files)
+	assert.Equal(t, 4, msg.Int)
+}
+
+func TestMessengerContext(t *testing.T) {
+	m0, m1 := newMessengerPair(t)
+	defer m0.Close()
+	defer m1.Close()
+
+	// A cancelled context unblocks Recv.
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		cancel()
+	}()
+	msg := typedTestMsg{}
+	assert.Equal(t, context.Canceled, m1.RecvContext(ctx, &msg))
+	assert.Equal(t, context.Canceled, m1.RecvContext(ctx, &msg))
+
+	// The deadline of a context is the deadline of the connection.
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, m1.RecvContext(ctx, &msg))
+
+	// The deadline is reset after a call.
+	require.NoError(t, m0.SendContext(context.Background(), typedTestMsg{1}))
+	require.NoError(t, m1.RecvContext(context.Background(), &msg))
+	assert.Equal(t, 1, msg.Int)
+}
@@ -0,0 +1,671 @@
+// Copyright 2017 Grigory Zubankov. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+//
+// +build linux darwin
+
+package zerodt
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// A pid of a supervisor passed to a worker.
+	envWorker = "ZERODT_WORKER"
+	// A descriptor of the socket connected to the supervisor. It
+	// follows the descriptors of LISTEN_FDS.
+	envSupervisorFD = "ZERODT_SUPERVISOR_FD"
+)
+
+// rpcRestart is a method called by a worker to forward a restart to
+// the supervisor.
+const rpcRestart = "restart"
+
+// workerRestart is a restart forwarded by a worker.
+type workerRestart struct {
+	Options RestartOptions
+	Trigger RestartTrigger
+}
+
+// workerProcess is a worker started by a supervisor.
+type workerProcess struct {
+	p          *os.Process
+	generation int
+	startTime  time.Time
+	// accepted is set when the worker accepted the listeners. It is
+	// guarded by App's mutex.
+	accepted bool
+	// Closed when the worker exits.
+	exited chan struct{}
+	state  *os.ProcessState
+	err    error
+}
+
+// workerSlot is a place for a single worker. In prefork mode there are
+// several slots, each of them is restarted independently.
+type workerSlot struct {
+	index  int
+	worker *workerProcess
+	// The number of workers that replaced the previous ones.
+	restarts int
+	crashes  int
+}
+
+// SetSupervisor enables supervisor mode. The first process becomes a
+// thin supervisor that owns the listeners, the pid file, the status
+// file and the control socket. It never serves and spawns a worker, the
+// same executable that serves the inherited listeners. The pid of the
+// supervisor never changes, so it's suitable for systemd's Type=simple
+// services and containers.
+//
+// A restart replaces the worker. The supervisor runs the usual
+// handshake with a new worker on behalf of the old one and shuts the
+// old one down when the new one has accepted the listeners.
+//
+// The supervisor forwards SIGINT and SIGTERM to the workers.
+// A restart of a worker, by SIGUSR2 or by calling Restart, is forwarded
+// to the supervisor over a connection with its trigger and reason. A
+// worker that exits unexpectedly is respawned (see
+// SetCrashRestartPolicy).
+//
+// Must be called before ListenAndServe. Default value is false.
+func (a *App) SetSupervisor(enabled bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.supervisor = enabled
+}
+
+// SetPrefork enables supervisor mode with n workers that serve the
+// same listeners. A restart rolls through the workers one at a time,
+// each of them is replaced using the usual handshake: a new worker of
+// a slot is started first and the old one is shut down when the new
+// one has accepted the listeners. The next slot is replaced when the
+// old worker has exited, so there are at most n+1 workers.
+//
+// Must be called before ListenAndServe. Default value is 1.
+func (a *App) SetPrefork(n int) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if n < 1 {
+		n = 1
+	}
+	a.supervisor = true
+	a.workersCount = n
+}
+
+// SetCrashRestartPolicy sets how a supervisor respawns a worker that
+// exited unexpectedly. A new worker gets the listeners kept by the
+// supervisor, so connections are queued by the kernel while there is
+// no worker.
+//
+// Default value is 100ms initial backoff, 30s maximum backoff and 5
+// crashes per minute as a crash loop.
+func (a *App) SetCrashRestartPolicy(p CrashRestartPolicy) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.crashPolicy = p
+}
+
+// isSupervisor checks whether the current process is a supervisor. It
+// must be called with mutex held.
+func (a *App) isSupervisor() bool {
+	return a.supervisor && a.masterPID == 0
+}
+
+// masterFromEnv returns a pid of a supervisor passed to a worker or 0.
+func masterFromEnv() int {
+	defer os.Unsetenv(envWorker)
+	pid, err := strconv.Atoi(os.Getenv(envWorker))
+	if err != nil || pid < 1 {
+		return 0
+	}
+	return pid
+}
+
+// connectSupervisor starts a connection to the supervisor of a worker.
+func (a *App) connectSupervisor(f *os.File) {
+	m, err := ListenSocket(f)
+	if err != nil {
+		logger.Printf("failed to connect to the supervisor with: %v", err)
+		return
+	}
+	c := NewRPCConn(m)
+	go c.Serve()
+
+	a.mutex.Lock()
+	a.supervisorConn = c
+	a.mutex.Unlock()
+}
+
+// forwardRestart asks the supervisor to restart the workers. It
+// returns as soon as the supervisor gets the request, since the worker
+// itself is replaced by the restart. A supervisor that passed no
+// connection is signaled.
+func (a *App) forwardRestart(masterPID int, opts RestartOptions, trigger RestartTrigger) error {
+	a.mutex.Lock()
+	c := a.supervisorConn
+	a.mutex.Unlock()
+	logger.Printf("forwarding restart to the supervisor %d", masterPID)
+	if c == nil {
+		return signalProcess(masterPID, syscall.SIGUSR2)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), controlTimeout)
+	defer cancel()
+	return c.Call(ctx, rpcRestart, workerRestart{opts, trigger}, &struct{}{})
+}
+
+// serveWorker handles calls of a worker until it closes the connection.
+func (a *App) serveWorker(f *os.File) {
+	m, err := ListenSocket(f)
+	if err != nil {
+		logger.Printf("failed to listen worker socket: %v", err)
+		return
+	}
+	c := NewRPCConn(m)
+	c.Handle(rpcRestart, func(ctx context.Context, req *RPCRequest, w *RPCReplyWriter) error {
+		r := workerRestart{}
+		err := req.Decode(&r)
+		if err != nil {
+			return err
+		}
+		// Nothing to do with errors, they are in the status.
+		go a.restart(r.Options, r.Trigger)
+		return w.Send(struct{}{})
+	})
+	go func() {
+		c.Serve()
+		c.Close()
+	}()
+}
+
+// supervise is ListenAndServe of a supervisor.
+func (a *App) supervise() error {
+	inherited, messenger, files, err := a.inherit()
+	if err != nil {
+		logger.Printf("failed to inherit listeners with: %v", err)
+		return err
+	}
+	err = a.lockPIDFile(files[pidLockFDName])
+	if err != nil {
+		logger.Printf("failed to lock pid file with: %v", err)
+		if messenger != nil {
+			messenger.Close()
+		}
+		return err
+	}
+	e := newRegistry(inherited)
+	logger.Printf("supervising with pid=%d, inherited=%s", os.Getpid(), formatInherited(e))
+
+	signals := make(chan os.Signal, 10)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR2)
+	defer signal.Stop(signals)
+
+	// Create or acquire listeners for all servers. The supervisor
+	// keeps them for workers.
+	a.mutex.Lock()
+	a.registry = e
+	a.workerExits = make(chan *workerProcess, 10)
+	a.workerExitsDone = make(chan struct{})
+	a.slots = make([]*workerSlot, a.workersCount)
+	for i := range a.slots {
+		a.slots[i] = &workerSlot{index: i}
+	}
+	a.initGeneration()
+	a.owner = messenger == nil
+	a.writeStatusFile()
+	a.writePIDFile()
+	if a.owner {
+		err = a.listenControlSocket()
+		if err == nil {
+			err = a.listenRendezvousSocket()
+		}
+	}
+	for _, as := range a.servers {
+		e.expectKey(as.key)
+	}
+	for _, as := range a.servers {
+		if err != nil {
+			break
+		}
+		err = a.listen(as)
+	}
+	info := a.workerGeneration("start")
+	a.mutex.Unlock()
+
+	// A supervisor may replace a process that is not supervised.
+	if messenger != nil {
+		if err == nil {
+			err = protocolActAsChild(a.handshakeCtx, messenger, a.waitChildTimeout, a.waitParentShutdownTimeout, a.heartbeatInterval, func(drainingPIDs []int, shutdownPID int) {
+				a.takeOver(drainingPIDs, shutdownPID)
+				a.PreParentExitFn()
+			}, a.DrainReportFn)
+		} else {
+			messenger.Close()
+		}
+	}
+	for _, slot := range a.slots {
+		if err != nil {
+			break
+		}
+		_, err = a.replaceWorker(e, slot, info, RestartOptions{})
+	}
+	if err != nil {
+		a.stopWorkers()
+	}
+	if err == nil {
+		a.mutex.Lock()
+		a.started = true
+		a.setState(StateServing)
+		a.mutex.Unlock()
+
+		err = a.superviseWorkers(signals)
+	}
+	// Nobody waits for workers to exit since now.
+	close(a.workerExitsDone)
+	if err != nil {
+		logger.Printf("supervisor failed with: %v", err)
+	}
+
+	a.mutex.Lock()
+	a.setState(StateStopped)
+	a.removePIDFile()
+	a.closeControlSocket()
+	a.closeRendezvousSocket()
+	a.mutex.Unlock()
+	a.controlWG.Wait()
+	a.syncStatusFile()
+
+	return err
+}
+
+// superviseWorkers handles signals and workers exits until the
+// supervisor is shutdown or workers crash in a loop.
+func (a *App) superviseWorkers(signals chan os.Signal) error {
+	var bgWG sync.WaitGroup
+	defer bgWG.Wait()
+	background := func(fn func()) {
+		bgWG.Add(1)
+		go func() {
+			defer bgWG.Done()
+			fn()
+		}()
+	}
+
+	type respawnError struct {
+		slot *workerSlot
+		err  error
+	}
+	respawns := make(chan *workerSlot, len(a.slots))
+	respawnErrs := make(chan respawnError, len(a.slots))
+	crashed := func(slot *workerSlot, pid int, err error) error {
+		logger.Printf("worker %d of slot %d crashed: %v", pid, slot.index, err)
+		a.WorkerCrashFn(pid, err)
+		delay, err := a.recordCrash(slot)
+		if err != nil {
+			a.stopWorkers()
+			return err
+		}
+		logger.Printf("respawning worker of slot %d in %v...", slot.index, delay)
+		time.AfterFunc(delay, func() { respawns <- slot })
+		return nil
+	}
+
+	for {
+		select {
+		case s := <-signals:
+			logger.Printf("%v signal", s)
+			switch s {
+			case syscall.SIGINT, syscall.SIGTERM:
+				background(a.Shutdown)
+			case syscall.SIGUSR2:
+				background(func() {
+					// Nothing to do with errors.
+					a.restart(RestartOptions{Reason: s.String()}, TriggerSignal)
+				})
+			}
+		case w := <-a.workerExits:
+			a.mutex.Lock()
+			slot := a.findSlot(w)
+			if slot != nil {
+				slot.worker = nil
+			}
+			a.mutex.Unlock()
+			if slot == nil {
+				logger.Printf("worker %d has exited: %v", w.p.Pid, w.exitReason())
+				continue
+			}
+			err := crashed(slot, w.p.Pid, fmt.Errorf("exited unexpectedly: %v", w.exitReason()))
+			if err != nil {
+				return err
+			}
+		case slot := <-respawns:
+			background(func() {
+				err := a.respawnWorker(slot)
+				if err != nil {
+					respawnErrs <- respawnError{slot, err}
+				}
+			})
+		case re := <-respawnErrs:
+			err := crashed(re.slot, 0, fmt.Errorf("failed to respawn: %v", re.err))
+			if err != nil {
+				return err
+			}
+		case <-a.done:
+			return nil
+		}
+	}
+}
+
+// findSlot returns a slot of the current worker or nil if the worker
+// is not current or the supervisor is shutting down. It must be called
+// with mutex held.
+func (a *App) findSlot(w *workerProcess) *workerSlot {
+	if a.wasShutdown {
+		return nil
+	}
+	for _, slot := range a.slots {
+		if slot.worker == w {
+			return slot
+		}
+	}
+	return nil
+}
+
+// recordCrash counts a crash and returns a delay before respawning a
+// worker or an error in case of a crash loop.
+func (a *App) recordCrash(slot *workerSlot) (time.Duration, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	now := time.Now()
+	p := a.crashPolicy
+	recent := []time.Time{}
+	for _, t := range a.crashes {
+		if p.CrashWindow == 0 || now.Sub(t) < p.CrashWindow {
+			recent = append(recent, t)
+		}
+	}
+	a.crashes = append(recent, now)
+	a.crashCount++
+	slot.crashes++
+	// Nobody is serving until a worker is respawned.
+	if a.servingWorkers() == 0 {
+		a.setState(StateRestarting)
+	}
+
+	if p.MaxCrashes > 0 && len(a.crashes) >= p.MaxCrashes {
+		return 0, fmt.Errorf("workers crashed %d times within %v", len(a.crashes), p.CrashWindow)
+	}
+	// MaxBackoff of 0 means no cap, the delay stops doubling before
+	// it overflows.
+	delay := p.InitialBackoff
+	for i := 1; i < len(a.crashes) && (p.MaxBackoff == 0 || delay < p.MaxBackoff) && delay <= math.MaxInt64/2; i++ {
+		delay *= 2
+	}
+	if p.MaxBackoff > 0 && delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+	return delay, nil
+}
+
+// servingWorkers returns the number of workers that have accepted the
+// listeners. It must be called with mutex held.
+func (a *App) servingWorkers() int {
+	n := 0
+	for _, slot := range a.slots {
+		if slot.worker != nil && slot.worker.accepted {
+			n++
+		}
+	}
+	return n
+}
+
+// respawnWorker starts a new worker instead of a crashed one. The
+// new worker's crash is handled the same way.
+func (a *App) respawnWorker(slot *workerSlot) error {
+	a.mutex.Lock()
+	// A restart may have already started a worker.
+	if a.wasShutdown || slot.worker != nil {
+		a.mutex.Unlock()
+		return nil
+	}
+	e := a.registry
+	info := a.workerGeneration("respawn after a crash")
+	a.mutex.Unlock()
+
+	pid, err := a.replaceWorker(e, slot, info, RestartOptions{})
+	if err != nil {
+		// The worker is killed and its exit is handled as a crash.
+		if pid != 0 {
+			return nil
+		}
+		return err
+	}
+	a.mutex.Lock()
+	if a.state == StateRestarting && a.restartOp == nil {
+		a.setState(StateServing)
+	}
+	a.mutex.Unlock()
+	logger.Printf("worker %d of slot %d has been respawned", pid, slot.index)
+	return nil
+}
+
+// workerGeneration describes a worker started by the supervisor
+// itself. It must be called with mutex held.
+func (a *App) workerGeneration(reason string) GenerationInfo {
+	return GenerationInfo{
+		Generation: a.generation,
+		ParentPID:  os.Getpid(),
+		Trigger:    TriggerSupervisor,
+		Reason:     reason,
+		Time:       time.Now(),
+	}
+}
+
+// replaceWorkers replaces workers of all slots one at a time. The
+// generation of the supervisor is the generation of its workers.
+func (a *App) replaceWorkers(e *Registry, info GenerationInfo, opts RestartOptions) (int, error) {
+	var pid int
+	for _, slot := range a.slots {
+		var err error
+		pid, err = a.replaceWorker(e, slot, info, opts)
+		if err != nil {
+			return pid, err
+		}
+	}
+	a.mutex.Lock()
+	a.generation = info.Generation
+	a.generationInfo = info
+	a.writeStatusFile()
+	a.mutex.Unlock()
+	return pid, nil
+}
+
+// replaceWorker starts a new worker of a slot and passes the listeners
+// to it. The current worker of the slot is shutdown when the new one
+// accepts the listeners.
+func (a *App) replaceWorker(e *Registry, slot *workerSlot, info GenerationInfo, opts RestartOptions) (int, error) {
+	var files []*os.File
+	var names []string
+	for _, pr := range e.activeListeners() {
+		files = append(files, pr.f)
+		names = append(names, pr.name)
+	}
+	env := []string{
+		fmt.Sprintf("%s=%d", envGeneration, info.Generation),
+		fmt.Sprintf("%s=%d", envWorker, os.Getpid()),
+		restartEnv(info),
+	}
+	// A worker forwards restarts over its own connection.
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return 0, err
+	}
+	syscall.CloseOnExec(fds[0])
+	syscall.CloseOnExec(fds[1])
+	local := os.NewFile(uintptr(fds[0]), "w|0")
+	remote := os.NewFile(uintptr(fds[1]), "w|1")
+	pid, f, err := a.forkExec(opts, files, names, []extraFile{{envSupervisorFD, remote}}, env)
+	remote.Close()
+	if err != nil {
+		local.Close()
+		logger.Printf("failed to forkExec: %v", err)
+		return 0, err
+	}
+	a.serveWorker(local)
+	w := a.watchWorker(pid, info.Generation)
+
+	a.mutex.Lock()
+	old := slot.worker
+	// The first worker and a worker respawned after a crash are the
+	// current ones since they start. Their crashes are handled.
+	if old == nil {
+		slot.worker = w
+	}
+	a.mutex.Unlock()
+	// There is nobody to shutdown instead of them.
+	shutdownPID := -1
+	if old != nil {
+		shutdownPID = old.p.Pid
+	}
+
+	m, err := ListenSocket(f)
+	if err == nil {
+		// A supervisor has no connections to report, so it sends no
+		// heartbeats.
+		err = protocolActAsParent(a.handshakeCtx, m, a.waitChildTimeout, a.waitParentShutdownTimeout, a.DrainingPIDs(), shutdownPID, nil, func() {
+			var draining []drainingProcess
+			if old != nil {
+				draining = runningProcesses(old.p.Pid)
+			}
+			a.mutex.Lock()
+			slot.worker = w
+			w.accepted = true
+			if old != nil {
+				slot.restarts++
+				a.draining = append(a.draining, draining...)
+			}
+			a.writeStatusFile()
+			a.mutex.Unlock()
+
+			if old != nil {
+				a.stopWorker(old, syscall.SIGTERM)
+			}
+		})
+	}
+	if err != nil {
+		logger.Printf("failed to start worker %d with: %v", pid, err)
+		// A supervisor does not leave a worker that failed to start.
+		w.p.Kill()
+	}
+	return pid, err
+}
+
+// watchWorker waits for a worker to exit in background.
+func (a *App) watchWorker(pid int, generation int) *workerProcess {
+	// Never fails on unix.
+	p, _ := os.FindProcess(pid)
+	w := &workerProcess{p: p, generation: generation, startTime: time.Now(), exited: make(chan struct{})}
+	exits, done := a.workerExits, a.workerExitsDone
+	go func() {
+		w.state, w.err = p.Wait()
+		close(w.exited)
+		select {
+		case exits <- w:
+		case <-done:
+		}
+	}()
+	return w
+}
+
+// stopWorker sends a signal to a worker and waits for it to exit.
+func (a *App) stopWorker(w *workerProcess, s os.Signal) {
+	logger.Printf("stopping worker %d with %v...", w.p.Pid, s)
+	err := w.p.Signal(s)
+	if err != nil {
+		logger.Printf("failed to send %v to worker %d: %v", s, w.p.Pid, err)
+	}
+	<-w.exited
+}
+
+// stopWorkers stops the current workers in parallel.
+func (a *App) stopWorkers() {
+	a.mutex.Lock()
+	var workers []*workerProcess
+	for _, slot := range a.slots {
+		if slot.worker != nil {
+			workers = append(workers, slot.worker)
+		}
+	}
+	a.mutex.Unlock()
+
+	var wg sync.WaitGroup
+	wg.Add(len(workers))
+	for _, w := range workers {
+		go func(w *workerProcess) {
+			defer wg.Done()
+			a.stopWorker(w, syscall.SIGTERM)
+		}(w)
+	}
+	wg.Wait()
+}
+
+// shutdownSupervisor waits for a restart in progress and stops the
+// current workers.
+func (a *App) shutdownSupervisor() {
+	a.mutex.Lock()
+	if a.wasShutdown {
+		a.mutex.Unlock()
+		return
+	}
+	a.wasShutdown = true
+	a.setState(StateDraining)
+	op := a.restartOp
+	a.mutex.Unlock()
+
+	// Let new workers accept the listeners, they are the ones to stop.
+	if op != nil {
+		<-op.done
+	}
+	a.stopWorkers()
+	close(a.done)
+}
+
+// workersStatus describes workers of all slots. It must be called with
+// mutex held.
+func (a *App) workersStatus() []WorkerStatus {
+	var result []WorkerStatus
+	for _, slot := range a.slots {
+		ws := WorkerStatus{Slot: slot.index, State: StateRestarting, Restarts: slot.restarts, Crashes: slot.crashes}
+		if w := slot.worker; w != nil {
+			ws.PID = w.p.Pid
+			ws.Generation = w.generation
+			ws.StartTime = w.startTime
+			ws.State = StateStarting
+			if w.accepted {
+				ws.State = StateServing
+			}
+		}
+		result = append(result, ws)
+	}
+	return result
+}
+
+func (w *workerProcess) exitReason() string {
+	if w.err != nil {
+		return w.err.Error()
+	}
+	return w.state.String()
+}
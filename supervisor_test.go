@@ -0,0 +1,103 @@
+// Copyright 2017 Grigory Zubankov. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+//
+// +build linux darwin
+
+package zerodt
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMasterFromEnv(t *testing.T) {
+	os.Setenv(envWorker, "42")
+	assert.Equal(t, 42, masterFromEnv())
+	assert.Empty(t, os.Getenv(envWorker))
+	assert.Equal(t, 0, masterFromEnv())
+
+	os.Setenv(envWorker, "bad")
+	assert.Equal(t, 0, masterFromEnv())
+}
+
+func TestSupervisorRole(t *testing.T) {
+	a := NewApp()
+	assert.False(t, a.isSupervisor())
+	a.SetSupervisor(true)
+	assert.True(t, a.isSupervisor())
+	// A worker.
+	a.masterPID = 42
+	assert.False(t, a.isSupervisor())
+
+	b := NewApp()
+	b.SetPrefork(0)
+	assert.True(t, b.isSupervisor())
+	assert.Equal(t, 1, b.workersCount)
+	b.SetPrefork(4)
+	assert.Equal(t, 4, b.workersCount)
+}
+
+func TestRecordCrash(t *testing.T) {
+	a := NewApp()
+	a.SetCrashRestartPolicy(CrashRestartPolicy{
+		InitialBackoff: time.Second,
+		MaxBackoff:     time.Second * 3,
+		MaxCrashes:     4,
+		CrashWindow:    time.Minute,
+	})
+
+	slot := &workerSlot{}
+	for _, expected := range []time.Duration{time.Second, time.Second * 2, time.Second * 3} {
+		delay, err := a.recordCrash(slot)
+		require.NoError(t, err)
+		assert.Equal(t, expected, delay)
+	}
+	assert.Equal(t, StateRestarting, a.State())
+
+	// Crash loop.
+	_, err := a.recordCrash(slot)
+	assert.Error(t, err)
+	assert.Equal(t, 4, a.Status().WorkerCrashes)
+	assert.Equal(t, 4, slot.crashes)
+
+	// Old crashes are forgotten.
+	a.crashes = []time.Time{time.Now().Add(-time.Hour)}
+	delay, err := a.recordCrash(slot)
+	require.NoError(t, err)
+	assert.Equal(t, time.Second, delay)
+}
+
+func TestRecordCrashBackoff(t *testing.T) {
+	cases := []struct {
+		maxBackoff time.Duration
+		expected   []time.Duration
+	}{
+		// No cap.
+		{0, []time.Duration{time.Second, time.Second * 2, time.Second * 4, time.Second * 8}},
+		{time.Second * 5, []time.Duration{time.Second, time.Second * 2, time.Second * 4, time.Second * 5}},
+		{time.Second, []time.Duration{time.Second, time.Second, time.Second, time.Second}},
+	}
+	for _, c := range cases {
+		a := NewApp()
+		a.SetCrashRestartPolicy(CrashRestartPolicy{InitialBackoff: time.Second, MaxBackoff: c.maxBackoff})
+		slot := &workerSlot{}
+		for _, expected := range c.expected {
+			delay, err := a.recordCrash(slot)
+			require.NoError(t, err)
+			assert.Equal(t, expected, delay, "max backoff %v", c.maxBackoff)
+		}
+	}
+
+	// The delay without a cap does not overflow.
+	a := NewApp()
+	a.SetCrashRestartPolicy(CrashRestartPolicy{InitialBackoff: time.Second})
+	a.crashes = make([]time.Time, 100)
+	delay, err := a.recordCrash(&workerSlot{})
+	require.NoError(t, err)
+	assert.True(t, delay > 0)
+}
@@ -0,0 +1,117 @@
+// Copyright 2017 Grigory Zubankov. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+//
+// +build linux darwin
+
+package zerodt
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+const (
+	// A socket to send notifications to systemd.
+	envNotifySocket = "NOTIFY_SOCKET"
+	// The longest FDNAME systemd accepts.
+	fdNameMax = 255
+)
+
+// SetSystemdFDStore enables passing the listeners to systemd's file
+// descriptor store. Listeners are stored with their keys as names
+// right after they are created or acquired, so the next process gets
+// them via socket activation even after a full restart (systemctl
+// restart). The listener of a removed server is removed from the
+// store. A listener with an empty key (a server with an empty address
+// and no key set) or a key longer than 255 bytes is not stored since
+// systemd rejects such names.
+//
+// The unit needs FileDescriptorStoreMax= and NotifyAccess=all if the
+// app is restarted with SIGUSR2 since systemd accepts notifications
+// from the main process only by default. Nothing is stored if the app
+// is not started by systemd.
+//
+// Default value is false.
+func (a *App) SetSystemdFDStore(enabled bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.fdStore = enabled
+}
+
+// storeListener passes a listener of a server to the systemd's file
+// descriptor store. It must be called with mutex held.
+func (a *App) storeListener(as *appServer) {
+	if !a.fdStore || a.masterPID != 0 {
+		return
+	}
+	name, ok := storeFDName(as.key)
+	if !ok {
+		logger.Printf("listener %q can't be stored in systemd: invalid name", as.key)
+		return
+	}
+	for _, pr := range a.registry.activeListeners() {
+		if pr.l != as.l {
+			continue
+		}
+		err := sdNotify(fmt.Sprintf("FDSTORE=1\nFDNAME=%s", name), pr.f)
+		if err != nil {
+			logger.Printf("failed to store listener %q in systemd with: %v", as.key, err)
+		}
+		return
+	}
+}
+
+// unstoreListener removes a listener of a server from the systemd's
+// file descriptor store. It must be called with mutex held.
+func (a *App) unstoreListener(as *appServer) {
+	if !a.fdStore || a.masterPID != 0 {
+		return
+	}
+	name, ok := storeFDName(as.key)
+	if !ok {
+		return
+	}
+	err := sdNotify(fmt.Sprintf("FDSTOREREMOVE=1\nFDNAME=%s", name))
+	if err != nil {
+		logger.Printf("failed to remove listener %q from systemd with: %v", as.key, err)
+	}
+}
+
+// storeFDName returns an encoded listener key that systemd accepts
+// as FDNAME or false if there is no such name.
+func storeFDName(key string) (string, bool) {
+	name := encodeFDName(key)
+	return name, name != "" && len(name) <= fdNameMax
+}
+
+// sdNotify sends a state to systemd with the given files. It does
+// nothing if there is no notify socket.
+func sdNotify(state string, files ...*os.File) error {
+	path := os.Getenv(envNotifySocket)
+	if path == "" {
+		return nil
+	}
+	fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	syscall.CloseOnExec(fd)
+
+	var oob []byte
+	if len(files) > 0 {
+		fds := make([]int, len(files))
+		for i, f := range files {
+			fds[i], err = fileFD(f)
+			if err != nil {
+				return err
+			}
+		}
+		oob = syscall.UnixRights(fds...)
+	}
+	// An abstract socket starts with '@' that is handled by syscall.
+	return syscall.Sendmsg(fd, []byte(state), oob, &syscall.SockaddrUnix{Name: path}, 0)
+}
@@ -0,0 +1,109 @@
+// Copyright 2017 Grigory Zubankov. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+//
+// +build linux darwin
+
+package zerodt
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recvNotify receives a notification with files sent by sdNotify.
+func recvNotify(t *testing.T, c *net.UnixConn) (string, []*os.File) {
+	b := make([]byte, 1024)
+	oob := make([]byte, syscall.CmsgSpace(4*4))
+	n, oobn, _, _, err := c.ReadMsgUnix(b, oob)
+	require.NoError(t, err)
+	cmsgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	require.NoError(t, err)
+	var files []*os.File
+	for _, cmsg := range cmsgs {
+		fds, err := syscall.ParseUnixRights(&cmsg)
+		require.NoError(t, err)
+		for _, fd := range fds {
+			files = append(files, os.NewFile(uintptr(fd), "notify"))
+		}
+	}
+	return string(b[:n]), files
+}
+
+func TestSystemdFDStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zerodt-systemd-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "notify.sock")
+	c, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	require.NoError(t, err)
+	defer c.Close()
+	os.Setenv(envNotifySocket, path)
+	defer os.Unsetenv(envNotifySocket)
+
+	a := NewApp()
+	a.SetSystemdFDStore(true)
+	a.registry = newRegistry(nil)
+	as := newAppServer(&http.Server{Addr: "127.0.0.1:0"})
+	as.key = "api:1"
+
+	a.mutex.Lock()
+	require.NoError(t, a.listen(as))
+	a.mutex.Unlock()
+	defer as.l.Close()
+
+	state, files := recvNotify(t, c)
+	assert.Equal(t, "FDSTORE=1\nFDNAME=api%3A1", state)
+	require.Len(t, files, 1)
+	defer files[0].Close()
+	// The stored descriptor is the listener.
+	l, err := net.FileListener(files[0])
+	require.NoError(t, err)
+	defer l.Close()
+	assert.Equal(t, as.l.Addr().String(), l.Addr().String())
+
+	a.mutex.Lock()
+	a.unstoreListener(as)
+	a.mutex.Unlock()
+	state, files = recvNotify(t, c)
+	assert.Equal(t, "FDSTOREREMOVE=1\nFDNAME=api%3A1", state)
+	assert.Empty(t, files)
+}
+
+func TestSystemdFDStoreEmptyKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zerodt-systemd-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "notify.sock")
+	c, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	require.NoError(t, err)
+	defer c.Close()
+	os.Setenv(envNotifySocket, path)
+	defer os.Unsetenv(envNotifySocket)
+
+	a := NewApp()
+	a.SetSystemdFDStore(true)
+	a.registry = newRegistry(nil)
+	as := newAppServer(&http.Server{Addr: "127.0.0.1:0"})
+
+	a.mutex.Lock()
+	require.NoError(t, a.listen(as))
+	a.unstoreListener(as)
+	a.mutex.Unlock()
+	defer as.l.Close()
+
+	// systemd rejects an empty FDNAME, so nothing is sent.
+	require.NoError(t, c.SetReadDeadline(time.Now().Add(time.Millisecond*100)))
+	_, _, err = c.ReadFrom(make([]byte, 1024))
+	ne, ok := err.(net.Error)
+	assert.True(t, ok && ne.Timeout(), "unexpected notification: %v", err)
+}